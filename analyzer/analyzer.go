@@ -12,30 +12,55 @@ import (
 
 // AnalysisInfo contains the result from analyzing a photo.
 type AnalysisInfo struct {
-	Date  *time.Time
-	Path  string
-	Error error
+	Date *time.Time
+	Path string
+	// Orientation is the EXIF orientation, 1 through 8. 1 is upright.
+	Orientation int
+	// Keywords are the IPTC and XMP keywords of the photo.
+	Keywords []string
+	Error    error
 }
 
 // Analyze takes in a path to a photo and will send the result to the Analyzer's
 // results channel.
 func Analyze(path string, resultsChan chan *AnalysisInfo) {
 	analysisInfo := &AnalysisInfo{
-		Path: path,
+		Path:        path,
+		Orientation: 1,
 	}
-	date, err := getDateForPhoto(path)
+
+	index, err := getExifIndex(path)
+	if err != nil && err != io.EOF {
+		log.WithError(err).Warnf("failed to read exif %q", path)
+	}
+
+	date, err := getDateForPhoto(path, index)
 	if err != nil {
 		analysisInfo.Error = err
 	} else {
 		analysisInfo.Date = date
 	}
 
+	if index != nil {
+		analysisInfo.Orientation = getOrientationFromExif(index)
+	}
+
+	keywords, err := getKeywords(path)
+	if err != nil && err != io.EOF {
+		log.WithError(err).Warnf("failed to read keywords %q", path)
+	}
+	analysisInfo.Keywords = keywords
+
 	resultsChan <- analysisInfo
 }
 
-func getDateForPhoto(path string) (*time.Time, error) {
-	date, err := getDateFromExif(path)
-	if err != nil && err != io.EOF {
+func getDateForPhoto(path string, index *exif.IfdIndex) (*time.Time, error) {
+	var date *time.Time
+	var err error
+	if index != nil {
+		date, err = getDateFromExif(path, *index)
+	}
+	if err != nil {
 		log.WithError(err).Warnf("failed to get date from exif %q", path)
 	}
 	if date != nil {
@@ -44,8 +69,6 @@ func getDateForPhoto(path string) (*time.Time, error) {
 
 	date, err = getDateFromFile(path)
 	if err != nil {
-		// Should never happen.
-		log.WithError(err).Fatalf("failed to get date from file %q", path)
 		return nil, err
 	}
 	if date != nil {
@@ -55,7 +78,7 @@ func getDateForPhoto(path string) (*time.Time, error) {
 	return nil, fmt.Errorf("no date found for %s", path)
 }
 
-func findAnyExifTag(index exif.IfdIndex) string {
+func findAnyExifTag(index exif.IfdIndex) (string, error) {
 	var tagEntry *exif.IfdTagEntry
 outer:
 	for _, value := range index.Ifds {
@@ -67,7 +90,7 @@ outer:
 				}
 			}
 			if len(tagEntries) > 1 {
-				log.Fatalf("found multiple %q tag entries, which should be impossible", tagName)
+				return "", fmt.Errorf("found multiple %q tag entries, which should be impossible", tagName)
 			}
 
 			if len(tagEntries) == 0 {
@@ -81,36 +104,73 @@ outer:
 
 	// Didn't find anything.
 	if tagEntry == nil {
-		return ""
+		return "", nil
 	}
 
 	valueRaw, err := tagEntry.Value()
 	if err != nil {
-		log.WithError(err).Fatal("error parsing value from tag entry")
+		return "", fmt.Errorf("error parsing value from tag entry: %w", err)
+	}
+	value, ok := valueRaw.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected %T value in tag entry", valueRaw)
 	}
 
-	return valueRaw.(string)
+	return value, nil
 }
 
-func getDateFromExif(path string) (*time.Time, error) {
+// getExifIndex reads the exif structure from the photo. A nil index is returned
+// if the photo has no exif data.
+func getExifIndex(path string) (*exif.IfdIndex, error) {
 	rawExif, err := exif.SearchFileAndExtractExif(path)
 	if err != nil {
 		if err.Error() == "no exif data" {
-			return nil, err
+			return nil, nil
 		}
-		log.WithError(err).Fatalf("error searching for exif data in file")
+		return nil, fmt.Errorf("error searching for exif data in file: %w", err)
 	}
 	im, err := exifcommon.NewIfdMappingWithStandard()
 	if err != nil {
-		log.WithError(err).Fatalf("error creating mapping")
+		return nil, fmt.Errorf("error creating mapping: %w", err)
 	}
 	tagIndex := exif.NewTagIndex()
 	_, index, err := exif.Collect(im, tagIndex, rawExif)
 	if err != nil {
-		log.WithError(err).Fatalf("error collecting exif structure")
+		return nil, fmt.Errorf("error collecting exif structure: %w", err)
 	}
 
-	dateString := findAnyExifTag(index)
+	return &index, nil
+}
+
+// getOrientationFromExif returns the Orientation tag, or 1 (upright) if it is
+// missing or invalid.
+func getOrientationFromExif(index *exif.IfdIndex) int {
+	ifd, ok := index.Lookup[exifcommon.IfdStandardIfdIdentity.String()]
+	if !ok {
+		return 1
+	}
+	tagEntries, err := ifd.FindTagWithName("Orientation")
+	if err != nil || len(tagEntries) == 0 {
+		return 1
+	}
+	valueRaw, err := tagEntries[0].Value()
+	if err != nil {
+		log.WithError(err).Warn("error parsing orientation from tag entry")
+		return 1
+	}
+	values, ok := valueRaw.([]uint16)
+	if !ok || len(values) == 0 || values[0] < 1 || values[0] > 8 {
+		return 1
+	}
+
+	return int(values[0])
+}
+
+func getDateFromExif(path string, index exif.IfdIndex) (*time.Time, error) {
+	dateString, err := findAnyExifTag(index)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, format := range []string{"2006:01:02 15:04:05", "2006:01:02 15:04: 5", "2006:01:02 15:04", "2006:01:02"} {
 		date, err := time.Parse(format, dateString)
@@ -0,0 +1,255 @@
+package analyzer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// JPEG markers of the segments keywords are read from. Reading stops at the
+// start of the image data.
+const (
+	markerAPP1  = 0xE1
+	markerAPP13 = 0xED
+	markerSOS   = 0xDA
+	markerEOI   = 0xD9
+)
+
+var (
+	xmpHeader       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	photoshopHeader = []byte("Photoshop 3.0\x00")
+)
+
+// iptcResourceID is the Photoshop image resource holding IPTC data.
+const iptcResourceID = 0x0404
+
+// The IPTC dataset of a keyword. Each keyword is a separate dataset.
+const (
+	iptcApplicationRecord = 2
+	iptcKeywords          = 25
+)
+
+const (
+	namespaceDC  = "http://purl.org/dc/elements/1.1/"
+	namespaceRDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+)
+
+var errNotJPEG = errors.New("not a jpeg")
+
+// getKeywords returns the IPTC and XMP (dc:subject) keywords of a JPEG, in the
+// order they are found, without duplicates.
+func getKeywords(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keywords []string
+	err = readSegments(bufio.NewReader(file), func(marker byte, data []byte) {
+		switch {
+		case marker == markerAPP13 && bytes.HasPrefix(data, photoshopHeader):
+			keywords = append(keywords, iptcKeywordsFromResources(data[len(photoshopHeader):])...)
+		case marker == markerAPP1 && bytes.HasPrefix(data, xmpHeader):
+			keywords = append(keywords, xmpKeywords(data[len(xmpHeader):])...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return uniqueKeywords(keywords), nil
+}
+
+// readSegments calls found with the marker and data of every APP1 and APP13
+// segment before the image data.
+func readSegments(reader *bufio.Reader, found func(marker byte, data []byte)) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(reader, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return errNotJPEG
+	}
+
+	for {
+		prefix, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if prefix != 0xFF {
+			return errNotJPEG
+		}
+		marker, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case marker == 0xFF:
+			// Fill byte before a marker.
+			reader.UnreadByte()
+			continue
+		case marker == markerSOS || marker == markerEOI:
+			return nil
+		case marker >= 0xD0 && marker <= 0xD7, marker == 0x01:
+			// Markers without a length.
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if length < 2 {
+			return errNotJPEG
+		}
+		if marker != markerAPP1 && marker != markerAPP13 {
+			if _, err := reader.Discard(int(length) - 2); err != nil {
+				return err
+			}
+			continue
+		}
+		data := make([]byte, length-2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		found(marker, data)
+	}
+}
+
+// iptcKeywordsFromResources finds the IPTC data in Photoshop image resources.
+// Each resource is "8BIM", its ID, a padded Pascal string name and its padded
+// data.
+func iptcKeywordsFromResources(data []byte) []string {
+	var keywords []string
+	for len(data) >= 4 && bytes.Equal(data[:4], []byte("8BIM")) {
+		data = data[4:]
+		if len(data) < 3 {
+			break
+		}
+		id := binary.BigEndian.Uint16(data)
+		data = data[2:]
+		nameLength := 1 + int(data[0])
+		nameLength += nameLength % 2
+		if len(data) < nameLength+4 {
+			break
+		}
+		data = data[nameLength:]
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size > len(data) {
+			break
+		}
+		if id == iptcResourceID {
+			keywords = append(keywords, iptcKeywordsFromDatasets(data[:size])...)
+		}
+		size += size % 2
+		if size > len(data) {
+			break
+		}
+		data = data[size:]
+	}
+	return keywords
+}
+
+// iptcKeywordsFromDatasets reads the keywords out of IPTC datasets. Each
+// dataset is 0x1C, the record, the dataset number, its length and its value.
+func iptcKeywordsFromDatasets(data []byte) []string {
+	var keywords []string
+	for len(data) >= 5 && data[0] == 0x1C {
+		record, dataset := data[1], data[2]
+		length := int(binary.BigEndian.Uint16(data[3:]))
+		data = data[5:]
+		if length&0x8000 != 0 {
+			// Extended datasets give the number of bytes of their length.
+			// Keywords are never this long.
+			lengthSize := length & 0x7FFF
+			if lengthSize > 4 || len(data) < lengthSize {
+				break
+			}
+			length = 0
+			for _, b := range data[:lengthSize] {
+				length = length<<8 | int(b)
+			}
+			data = data[lengthSize:]
+		}
+		if length > len(data) {
+			break
+		}
+		if record == iptcApplicationRecord && dataset == iptcKeywords {
+			keywords = append(keywords, iptcString(data[:length]))
+		}
+		data = data[length:]
+	}
+	return keywords
+}
+
+// iptcString decodes an IPTC value. Most writers use UTF-8 now, and older ones
+// Latin-1.
+func iptcString(value []byte) string {
+	if utf8.Valid(value) {
+		return string(value)
+	}
+	runes := make([]rune, len(value))
+	for index, b := range value {
+		runes[index] = rune(b)
+	}
+	return string(runes)
+}
+
+// xmpKeywords reads the items of the dc:subject bag of an XMP packet.
+func xmpKeywords(packet []byte) []string {
+	var keywords []string
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	inSubject, inItem := false, false
+	var item strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			// Keep what was read before a malformed part.
+			return keywords
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			switch {
+			case token.Name.Space == namespaceDC && token.Name.Local == "subject":
+				inSubject = true
+			case inSubject && token.Name.Space == namespaceRDF && token.Name.Local == "li":
+				inItem = true
+				item.Reset()
+			}
+		case xml.CharData:
+			if inItem {
+				item.Write(token)
+			}
+		case xml.EndElement:
+			switch {
+			case token.Name.Space == namespaceDC && token.Name.Local == "subject":
+				inSubject = false
+			case inItem && token.Name.Space == namespaceRDF && token.Name.Local == "li":
+				inItem = false
+				keywords = append(keywords, item.String())
+			}
+		}
+	}
+}
+
+// uniqueKeywords trims keywords and drops empty ones and those differing only
+// in case from an earlier one.
+func uniqueKeywords(keywords []string) []string {
+	seen := map[string]bool{}
+	unique := make([]string, 0, len(keywords))
+	for _, keyword := range keywords {
+		keyword = strings.TrimSpace(keyword)
+		key := strings.ToLower(keyword)
+		if keyword == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, keyword)
+	}
+	return unique
+}
@@ -0,0 +1,170 @@
+package analyzer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// segment is a JPEG segment with its marker and length.
+func segment(marker byte, data ...[]byte) []byte {
+	body := bytes.Join(data, nil)
+	var buffer bytes.Buffer
+	buffer.Write([]byte{0xFF, marker})
+	binary.Write(&buffer, binary.BigEndian, uint16(len(body)+2))
+	buffer.Write(body)
+	return buffer.Bytes()
+}
+
+// jpegFile is a JPEG with the segments and no image data.
+func jpegFile(segments ...[]byte) []byte {
+	data := []byte{0xFF, 0xD8}
+	data = append(data, segment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))...)
+	data = append(data, bytes.Join(segments, nil)...)
+	return append(data, 0xFF, markerEOI)
+}
+
+// resource is a Photoshop image resource, padded to an even length.
+func resource(id uint16, name string, data []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("8BIM")
+	binary.Write(&buffer, binary.BigEndian, id)
+	buffer.WriteByte(byte(len(name)))
+	buffer.WriteString(name)
+	if len(name)%2 == 0 {
+		buffer.WriteByte(0)
+	}
+	binary.Write(&buffer, binary.BigEndian, uint32(len(data)))
+	buffer.Write(data)
+	if len(data)%2 == 1 {
+		buffer.WriteByte(0)
+	}
+	return buffer.Bytes()
+}
+
+func iptcSegment(resources ...[]byte) []byte {
+	return segment(markerAPP13, photoshopHeader, bytes.Join(resources, nil))
+}
+
+// keyword is an IPTC keyword dataset.
+func keyword(value string) []byte {
+	var buffer bytes.Buffer
+	buffer.Write([]byte{0x1C, iptcApplicationRecord, iptcKeywords})
+	binary.Write(&buffer, binary.BigEndian, uint16(len(value)))
+	buffer.WriteString(value)
+	return buffer.Bytes()
+}
+
+// extendedKeyword is an IPTC keyword dataset with a two byte extended length.
+func extendedKeyword(value string) []byte {
+	var buffer bytes.Buffer
+	buffer.Write([]byte{0x1C, iptcApplicationRecord, iptcKeywords, 0x80, 0x02})
+	binary.Write(&buffer, binary.BigEndian, uint16(len(value)))
+	buffer.WriteString(value)
+	return buffer.Bytes()
+}
+
+func iptc(datasets ...[]byte) []byte {
+	return resource(iptcResourceID, "", bytes.Join(datasets, nil))
+}
+
+func xmpSegment(items ...string) []byte {
+	var packet bytes.Buffer
+	packet.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="` + namespaceRDF + `">`)
+	packet.WriteString(`<rdf:Description xmlns:dc="` + namespaceDC + `"><dc:title><rdf:Alt><rdf:li>Not a keyword</rdf:li></rdf:Alt></dc:title><dc:subject><rdf:Bag>`)
+	for _, item := range items {
+		packet.WriteString("<rdf:li>" + item + "</rdf:li>")
+	}
+	packet.WriteString(`</rdf:Bag></dc:subject></rdf:Description></rdf:RDF></x:xmpmeta>`)
+	return segment(markerAPP1, xmpHeader, packet.Bytes())
+}
+
+func TestGetKeywords(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []string
+		wantErr error
+	}{
+		{"no keywords", jpegFile(), []string{}, nil},
+		{"iptc only", jpegFile(iptcSegment(iptc(keyword("Beach"), keyword("Alice")))), []string{"Beach", "Alice"}, nil},
+		{"xmp only", jpegFile(xmpSegment("Beach", "Alice &amp; Bob")), []string{"Beach", "Alice & Bob"}, nil},
+		{
+			"both, without duplicates",
+			jpegFile(iptcSegment(iptc(keyword("Beach"), keyword(" alice "), keyword(""))), xmpSegment("beach", "Bob", "ALICE", " ")),
+			[]string{"Beach", "alice", "Bob"},
+			nil,
+		},
+		{"utf-8 iptc", jpegFile(iptcSegment(iptc(keyword("Café")))), []string{"Café"}, nil},
+		{"latin-1 iptc", jpegFile(iptcSegment(iptc(keyword("Caf\xe9 M\xfcller")))), []string{"Café Müller"}, nil},
+		{
+			"other records and resources",
+			jpegFile(iptcSegment(
+				resource(0x0425, "", make([]byte, 16)),
+				iptc([]byte{0x1C, 2, 5, 0, 5}, []byte("Title"), keyword("Beach"), []byte{0x1C, 1, 25, 0, 3}, []byte("Foo")),
+			)),
+			[]string{"Beach"},
+			nil,
+		},
+		{
+			"odd length names and data are padded",
+			jpegFile(iptcSegment(resource(0x0425, "odd", []byte{1, 2, 3}), iptc(keyword("Odd")), iptc(keyword("Next")))),
+			[]string{"Odd", "Next"},
+			nil,
+		},
+		{
+			"truncated resource",
+			jpegFile(iptcSegment(iptc(keyword("Beach")), iptc(keyword("Truncated"))[:20])),
+			[]string{"Beach"},
+			nil,
+		},
+		{
+			"truncated resource header",
+			jpegFile(iptcSegment(iptc(keyword("Beach")), []byte("8BIM\x04"))),
+			[]string{"Beach"},
+			nil,
+		},
+		{
+			"resource larger than the segment",
+			jpegFile(iptcSegment([]byte("8BIM\x04\x04\x00\x00\x00\x00\x10\x00"), keyword("Beach"))),
+			[]string{},
+			nil,
+		},
+		{
+			"truncated dataset",
+			jpegFile(iptcSegment(resource(iptcResourceID, "", append(keyword("Beach"), keyword("Truncated")[:8]...)))),
+			[]string{"Beach"},
+			nil,
+		},
+		{"extended length dataset", jpegFile(iptcSegment(iptc(extendedKeyword("Long"), keyword("Short")))), []string{"Long", "Short"}, nil},
+		{
+			"extended length too long",
+			jpegFile(iptcSegment(iptc(keyword("Beach"), []byte{0x1C, 2, 25, 0x80, 0x08, 0, 0, 0, 0, 0, 0, 0, 4}, []byte("Long")))),
+			[]string{"Beach"},
+			nil,
+		},
+		{"malformed xmp", jpegFile(segment(markerAPP1, xmpHeader, []byte(`<x:xmpmeta><dc:subject xmlns:dc="`+namespaceDC+`"><rdf:li xmlns:rdf="`+namespaceRDF+`">Beach</rdf:li><rdf:li`))), []string{"Beach"}, nil},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), nil, errNotJPEG},
+		{"empty", []byte{}, nil, errNotJPEG},
+		{"garbage between segments", []byte{0xFF, 0xD8, 0x00, 0x01}, nil, errNotJPEG},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "photo.jpg")
+			if err := os.WriteFile(path, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			keywords, err := getKeywords(path)
+			if err != test.wantErr {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(keywords, test.want) {
+				t.Errorf("got keywords %q, want %q", keywords, test.want)
+			}
+		})
+	}
+}
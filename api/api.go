@@ -7,30 +7,43 @@ import (
 	"github.com/graphql-go/graphql"
 	log "github.com/sirupsen/logrus"
 	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/events"
+	"github.com/williamhaley/photo-server/indexer"
 	"github.com/williamhaley/photo-server/model"
+	"github.com/williamhaley/photo-server/thumbnail"
 )
 
 // API handles all abstractions around the API.
 type API struct {
-	db     *datasource.Database
-	schema graphql.Schema
+	db               *datasource.Database
+	thumbnailManager *thumbnail.Manager
+	indexer          *indexer.Indexer
+	events           *events.Bus
+	schema           graphql.Schema
 }
 
-// New returns a new instance of the API.
-func New(db *datasource.Database) *API {
-	return &API{
-		db:     db,
-		schema: newSchema(),
+// New returns a new instance of the API. The thumbnail manager and indexer are
+// used by mutations, which publish changed photos to the event bus.
+func New(db *datasource.Database, thumbnailManager *thumbnail.Manager, indexer *indexer.Indexer, eventBus *events.Bus) *API {
+	api := &API{
+		db:               db,
+		thumbnailManager: thumbnailManager,
+		indexer:          indexer,
+		events:           eventBus,
 	}
+	api.schema = newSchema(api.mutations())
+	return api
 }
 
-func (api *API) BucketCounts() ([]interface{}, error) {
+// BucketCounts returns the months with photos visible to the authenticated
+// user in the context.
+func (api *API) BucketCounts(ctx context.Context) ([]interface{}, error) {
 	log.Debug("[api:BucketCounts]")
 
-	result := api.query(`{counts{year,month,totalCount}}`)
+	result := api.Execute(ctx, `{counts{year,month,totalCount}}`, "", nil)
 	if len(result.Errors) > 0 {
 		for _, err := range result.Errors {
-			log.WithError(err)
+			log.WithError(err).Error("error retrieving bucket counts")
 		}
 		return nil, errors.New("error retrieving bucket counts")
 	}
@@ -40,18 +53,25 @@ func (api *API) BucketCounts() ([]interface{}, error) {
 	return parsed.([]interface{}), nil
 }
 
-func (api *API) BucketPhotos(bucketID, after string) (interface{}, error) {
+// BucketPhotos returns a page of the photos in a month visible to the
+// authenticated user in the context.
+func (api *API) BucketPhotos(ctx context.Context, bucketID, after string) (interface{}, error) {
 	log.Debugf("[api:BucketPhotos] %q", bucketID)
 
-	result := api.query(fmt.Sprintf(`{
-		yearMonthBucket(id:"%s"){
-			photosConnection(first:20, after:"%s") {
+	result := api.Execute(ctx, `query BucketPhotos($id: String, $after: String) {
+		yearMonthBucket(id: $id){
+			photosConnection(first:20, after: $after) {
 				totalCount
 				edges{
 					node{
 						uuid
 						name
 						date
+						thumbnailSizes
+						blurHash
+						dominantColor
+						aspectRatio
+						orientation
 					}
 					cursor
 				}
@@ -61,10 +81,13 @@ func (api *API) BucketPhotos(bucketID, after string) (interface{}, error) {
 				}
 			}
 		}
-	}`, bucketID, after))
+	}`, "BucketPhotos", map[string]interface{}{
+		"id":    bucketID,
+		"after": after,
+	})
 	if len(result.Errors) > 0 {
 		for _, err := range result.Errors {
-			log.WithError(err)
+			log.WithError(err).Errorf("error retrieving photos for bucket %q", bucketID)
 		}
 		return nil, fmt.Errorf("error retrieving photos for bucket %q", bucketID)
 	}
@@ -74,11 +97,36 @@ func (api *API) BucketPhotos(bucketID, after string) (interface{}, error) {
 	return parsed, nil
 }
 
-// Query uses the provided query string to query GraphQL.
-func (api *API) query(query string) *graphql.Result {
+// Memories returns photos from around a date, as YYYY-MM-DD or "" for today,
+// in earlier years, for the authenticated user in the context.
+func (api *API) Memories(ctx context.Context, date string, windowDays, limit int) ([]*model.Memory, error) {
+	log.Debugf("[api:Memories] %q %d", date, windowDays)
+
+	return onThisDay(api.db, model.UserFromContext(ctx), date, windowDays, limit)
+}
+
+// Shuffle returns the next photos in the seed's random order, for the
+// authenticated user in the context.
+func (api *API) Shuffle(ctx context.Context, seed int, filter *model.PhotoFilter, first int, after string) (*ShufflePage, error) {
+	log.Debugf("[api:Shuffle] %d %q", seed, after)
+
+	return shuffle(api.db, model.UserFromContext(ctx), seed, filter, first, after)
+}
+
+// Execute runs a GraphQL request. Values are always passed as variables rather
+// than formatted into the query so they cannot change its meaning.
+func (api *API) Execute(ctx context.Context, query, operationName string, variables map[string]interface{}) *graphql.Result {
 	return graphql.Do(graphql.Params{
-		Schema:        api.schema,
-		RequestString: query,
-		Context:       context.WithValue(context.Background(), model.CtxDB, api.db),
+		Schema:         api.schema,
+		RequestString:  query,
+		OperationName:  operationName,
+		VariableValues: variables,
+		Context:        api.context(ctx),
 	})
 }
+
+func (api *API) context(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, model.CtxDB, api.db)
+	ctx = context.WithValue(ctx, ctxLoaders, newLoaders(api.db, model.UserFromContext(ctx), model.RoleFromContext(ctx)))
+	return context.WithValue(ctx, model.CtxThumbnailSizes, api.thumbnailManager.Sizes())
+}
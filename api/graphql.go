@@ -1,68 +1,178 @@
 package api
 
 import (
-	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"github.com/graph-gophers/dataloader"
 	"github.com/graphql-go/graphql"
 	log "github.com/sirupsen/logrus"
 	"github.com/williamhaley/photo-server/datasource"
 	"github.com/williamhaley/photo-server/model"
+	"time"
 )
 
 type Result struct {
-	Records    interface{}
-	LastCursor string
-	TotalCount int
-	HasMore    bool
+	Records         interface{}
+	StartCursor     string
+	EndCursor       string
+	TotalCount      int
+	HasPreviousPage bool
+	HasNextPage     bool
 }
 
-func NewResult(records interface{}, lastCursor string, count int, hasMore bool) *Result {
+func NewResult(records interface{}, startCursor, endCursor string, count int, hasPreviousPage, hasNextPage bool) *Result {
 	return &Result{
-		Records:    records,
-		LastCursor: lastCursor,
-		TotalCount: count,
-		HasMore:    hasMore,
+		Records:         records,
+		StartCursor:     startCursor,
+		EndCursor:       endCursor,
+		TotalCount:      count,
+		HasPreviousPage: hasPreviousPage,
+		HasNextPage:     hasNextPage,
 	}
 }
 
-// https://github.com/graphql-go/graphql-dataloader-example/blob/master/main.go
-var handleError = func(err error) []*dataloader.Result {
-	var results []*dataloader.Result
-	var result dataloader.Result
-	result.Error = err
-	results = append(results, &result)
-	return results
+// defaultPageSize is used when neither first nor last is given.
+const defaultPageSize = 10
+
+// connectionArgs are Relay's arguments for paging through a connection.
+var connectionArgs = graphql.FieldConfigArgument{
+	"first": &graphql.ArgumentConfig{
+		Type: graphql.Int,
+	},
+	"after": &graphql.ArgumentConfig{
+		Type: graphql.String,
+	},
+	"last": &graphql.ArgumentConfig{
+		Type: graphql.Int,
+	},
+	"before": &graphql.ArgumentConfig{
+		Type: graphql.String,
+	},
 }
 
-var yearMonthBucketLoader = dataloader.NewBatchedLoader(
-	func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
-		db := ctx.Value(model.CtxDB).(*datasource.Database)
+// stateFilterArgs narrow photos down by what the authenticated user marked
+// them as. minRating is from 0, which matches unrated photos too, to 5 stars.
+var stateFilterArgs = graphql.FieldConfigArgument{
+	"favorites": &graphql.ArgumentConfig{
+		Type:         graphql.Boolean,
+		DefaultValue: false,
+	},
+	"minRating": &graphql.ArgumentConfig{
+		Type:         graphql.Int,
+		DefaultValue: 0,
+	},
+}
 
-		yearMonthDates := keys.Keys()
-		results := make([]*dataloader.Result, len(yearMonthDates))
+// withStateFilterArgs adds stateFilterArgs to the arguments of a field.
+func withStateFilterArgs(args graphql.FieldConfigArgument) graphql.FieldConfigArgument {
+	for name, arg := range stateFilterArgs {
+		args[name] = arg
+	}
+	return args
+}
 
-		log.Debugf("[graphql:yearMonthBucketLoader]: %q", yearMonthDates)
+// filterFromArgs reads and validates a photo filter. Arguments the field does
+// not have are left empty.
+func filterFromArgs(args map[string]interface{}) (*model.PhotoFilter, error) {
+	filter := &model.PhotoFilter{}
+	filter.Folder, _ = args["folder"].(string)
+	filter.From, _ = args["from"].(string)
+	filter.To, _ = args["to"].(string)
+	filter.Favorites, _ = args["favorites"].(bool)
+	filter.MinRating, _ = args["minRating"].(int)
+	if err := checkFilter(filter); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
 
-		buckets, err := db.DateBucketsForIds(yearMonthDates...)
-		if err != nil {
-			return handleError(err)
+// checkFilter validates a photo filter from a request.
+func checkFilter(filter *model.PhotoFilter) error {
+	for _, date := range []string{filter.From, filter.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
 		}
+	}
+	if filter.MinRating < 0 || filter.MinRating > model.MaxRating {
+		return fmt.Errorf("minRating must be between 0 and %d", model.MaxRating)
+	}
+	return nil
+}
+
+// pageFromArgs validates the connection arguments. An empty cursor is the
+// same as none.
+func pageFromArgs(args map[string]interface{}) (*model.Page, error) {
+	first, hasFirst := args["first"].(int)
+	last, hasLast := args["last"].(int)
+	if hasFirst && hasLast {
+		return nil, errors.New("first and last may not be used together")
+	}
+	if (hasFirst && first < 1) || (hasLast && last < 1) {
+		return nil, errors.New("first and last must be at least 1")
+	}
+	if !hasFirst && !hasLast {
+		first = defaultPageSize
+	}
 
-		for index, bucket := range buckets {
-			results[index] = &dataloader.Result{
-				Data:  bucket,
-				Error: nil,
-			}
+	page := &model.Page{First: first, Last: last}
+	for name, cursor := range map[string]**model.PhotoCursor{"after": &page.After, "before": &page.Before} {
+		encoded, _ := args[name].(string)
+		if encoded == "" {
+			continue
 		}
+		decoded, err := model.DecodePhotoCursor(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		*cursor = decoded
+	}
 
-		return results
-	},
-)
+	return page, nil
+}
+
+// photosConnection resolves a page of photos, of a bucket or a tag, fetched by
+// photos.
+func photosConnection(params graphql.ResolveParams, photos func(db *datasource.Database, user string, page *model.Page) (*model.PhotoPage, error), count func() (interface{}, error)) (interface{}, error) {
+	page, err := pageFromArgs(params.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	db := params.Context.Value(model.CtxDB).(*datasource.Database)
+
+	result, err := photos(db, model.UserFromContext(params.Context), page)
+	if err != nil {
+		log.WithError(err).Error("error loading photos")
+		return nil, err
+	}
+
+	startCursor, endCursor := "", ""
+	if len(result.Photos) > 0 {
+		startCursor = result.Photos[0].Cursor()
+		endCursor = result.Photos[len(result.Photos)-1].Cursor()
+	}
+
+	return func() (interface{}, error) {
+		count, err := count()
+		if err != nil {
+			return nil, err
+		}
+		return NewResult(result.Photos, startCursor, endCursor, count.(int), result.HasPreviousPage, result.HasNextPage), nil
+	}, nil
+}
 
 var photosConnectionType = newConnectionResult(photoType)
 
+// photosInBucket fetches the pages of a bucket's photosConnection. The filter
+// may be nil.
+func photosInBucket(id string, filter *model.PhotoFilter) func(db *datasource.Database, user string, page *model.Page) (*model.PhotoPage, error) {
+	return func(db *datasource.Database, user string, page *model.Page) (*model.PhotoPage, error) {
+		return db.PhotosInBucket(user, id, filter, page)
+	}
+}
+
 var photoType = graphql.NewObject(graphql.ObjectConfig{
 	Name: "photo",
 	Fields: graphql.Fields{
@@ -78,6 +188,50 @@ var photoType = graphql.NewObject(graphql.ObjectConfig{
 		"date": &graphql.Field{
 			Type: graphql.DateTime,
 		},
+		// orientation changes when a photo is rotated. Thumbnails are cached
+		// forever, so include it in thumbnail URLs to pick up rotations.
+		"orientation": &graphql.Field{
+			Type: graphql.Int,
+		},
+		"hidden": &graphql.Field{
+			Type: graphql.Boolean,
+		},
+		"caption": &graphql.Field{
+			Type: graphql.String,
+		},
+		// What the authenticated user has marked the photo as, as opposed to
+		// hidden, which is the same for everyone.
+		"userState": &graphql.Field{
+			Type: photoUserStateType,
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				photo := params.Source.(*model.Photo)
+				return load(params.Context, loadersFromContext(params.Context).photoUserStates, photo.UUID), nil
+			},
+		},
+		// Kept for clients from before favorites were kept for each user. Same
+		// as userState's favorite.
+		"favorite": &graphql.Field{
+			Type: graphql.Boolean,
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				photo := params.Source.(*model.Photo)
+				state := load(params.Context, loadersFromContext(params.Context).photoUserStates, photo.UUID)
+				return func() (interface{}, error) {
+					value, err := state()
+					if err != nil {
+						return nil, err
+					}
+					return value.(*model.PhotoUserState).Favorite, nil
+				}, nil
+			},
+		},
+		// Names of the photo's tags.
+		"tags": &graphql.Field{
+			Type: graphql.NewList(graphql.String),
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				photo := params.Source.(*model.Photo)
+				return load(params.Context, loadersFromContext(params.Context).photoTags, photo.UUID), nil
+			},
+		},
 		"cursor": &graphql.Field{
 			Type: graphql.String,
 			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
@@ -85,6 +239,41 @@ var photoType = graphql.NewObject(graphql.ObjectConfig{
 				return photo.Cursor(), nil
 			},
 		},
+		// blurHash, dominantColor and aspectRatio let the UI draw a correctly
+		// sized placeholder before the thumbnail loads. They are empty until
+		// thumbnails have been generated for the photo.
+		"blurHash": &graphql.Field{
+			Type: graphql.String,
+		},
+		"dominantColor": &graphql.Field{
+			Type: graphql.String,
+		},
+		"aspectRatio": &graphql.Field{
+			Type: graphql.Float,
+		},
+		// Each size may be requested at thumbnail/{uuid}/{size} to build a srcset.
+		"thumbnailSizes": &graphql.Field{
+			Type: graphql.NewList(graphql.Int),
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				return params.Context.Value(model.CtxThumbnailSizes), nil
+			},
+		},
+	},
+})
+
+var photoUserStateType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "photoUserState",
+	Fields: graphql.Fields{
+		"favorite": &graphql.Field{
+			Type: graphql.Boolean,
+		},
+		// From 0, unrated, to 5 stars.
+		"rating": &graphql.Field{
+			Type: graphql.Int,
+		},
+		"hidden": &graphql.Field{
+			Type: graphql.Boolean,
+		},
 	},
 })
 
@@ -102,57 +291,128 @@ var yearMonthBucketType = graphql.NewObject(graphql.ObjectConfig{
 		},
 		"photosConnection": &graphql.Field{
 			Type: photosConnectionType,
-			Args: graphql.FieldConfigArgument{
-				"first": &graphql.ArgumentConfig{
-					Type:         graphql.Int,
-					DefaultValue: 10,
-				},
-				"after": &graphql.ArgumentConfig{
-					Type:         graphql.String,
-					DefaultValue: "",
-				},
-			},
+			Args: connectionArgs,
 			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
 				yearMonthBucket := params.Source.(*model.YearMonthBucket)
-				limit := params.Args["first"].(int)
-				decodedCursor, err := base64.StdEncoding.DecodeString(params.Args["after"].(string))
-				if err != nil {
-					log.WithError(err).Errorf("error decoding cursor %q", params.Args["after"])
-					return nil, err
-				}
-				after := string(decodedCursor)
-
-				year := yearMonthBucket.Year
-				month := yearMonthBucket.Month
-
-				log.Debugf("[graphql:resolvePhotosForYearMonth]: %d-%d %q", year, month, after)
-
-				db := params.Context.Value(model.CtxDB).(*datasource.Database)
-
-				photos, hasMore, err := db.AllPhotos(year, month, limit, after)
-				if err != nil {
-					log.WithError(err)
-					return nil, err
-				}
-
-				cursor := ""
-				if len(photos) > 0 {
-					lastPhoto := photos[len(photos)-1]
-					cursor = lastPhoto.Cursor()
-				}
-
-				count, err := db.PhotosCount(year, month)
-				if err != nil {
-					log.WithError(err)
-					return nil, err
-				}
-
-				return NewResult(photos, cursor, count, hasMore), nil
+
+				// Batched with the counts of every other bucket in the request.
+				key := fmt.Sprintf("%04d-%02d", yearMonthBucket.Year, yearMonthBucket.Month)
+				log.Debugf("[graphql:resolvePhotosForYearMonth]: %s %+v", key, params.Args)
+
+				return photosConnection(params, photosInBucket(key, nil), load(params.Context, loadersFromContext(params.Context).photoCounts, key))
+			},
+		},
+	},
+})
+
+var granularityType = graphql.NewEnum(graphql.EnumConfig{
+	Name: "Granularity",
+	Values: graphql.EnumValueConfigMap{
+		"YEAR":  &graphql.EnumValueConfig{Value: model.GranularityYear},
+		"MONTH": &graphql.EnumValueConfig{Value: model.GranularityMonth},
+		"DAY":   &graphql.EnumValueConfig{Value: model.GranularityDay},
+		"EVENT": &graphql.EnumValueConfig{Value: model.GranularityEvent},
+	},
+})
+
+var bucketType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "bucket",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type: graphql.String,
+		},
+		"granularity": &graphql.Field{
+			Type: granularityType,
+		},
+		"totalCount": &graphql.Field{
+			Type: graphql.Int,
+		},
+		"photosConnection": &graphql.Field{
+			Type: photosConnectionType,
+			Args: connectionArgs,
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				bucket := params.Source.(*model.Bucket)
+
+				log.Debugf("[graphql:resolvePhotosForBucket]: %q %+v", bucket.ID, params.Args)
+
+				// Filtered like the bucket itself.
+				return photosConnection(params, photosInBucket(bucket.ID, bucket.Filter), func() (interface{}, error) {
+					return bucket.TotalCount, nil
+				})
+			},
+		},
+	},
+})
+
+var tagType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "tag",
+	Fields: graphql.Fields{
+		"name": &graphql.Field{
+			Type: graphql.String,
+		},
+		"totalCount": &graphql.Field{
+			Type: graphql.Int,
+		},
+		"photosConnection": &graphql.Field{
+			Type: photosConnectionType,
+			Args: connectionArgs,
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				tag := params.Source.(*model.Tag)
+
+				log.Debugf("[graphql:resolvePhotosForTag]: %q %+v", tag.Name, params.Args)
+
+				return photosConnection(params, func(db *datasource.Database, user string, page *model.Page) (*model.PhotoPage, error) {
+					return db.PhotosWithTag(user, tag.Name, page)
+				}, func() (interface{}, error) {
+					return tag.TotalCount, nil
+				})
 			},
 		},
 	},
 })
 
+var memoryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "memory",
+	Fields: graphql.Fields{
+		"year": &graphql.Field{
+			Type: graphql.Int,
+		},
+		"yearsAgo": &graphql.Field{
+			Type: graphql.Int,
+		},
+		"totalCount": &graphql.Field{
+			Type: graphql.Int,
+		},
+		"photos": &graphql.Field{
+			Type: graphql.NewList(photoType),
+		},
+	},
+})
+
+// maxMemoryWindowDays limits how far either side of the date memories are
+// looked for.
+const maxMemoryWindowDays = 31
+
+// onThisDay returns the memories for a date, as YYYY-MM-DD, or for today in
+// the server's time zone.
+func onThisDay(db *datasource.Database, user, date string, windowDays, limit int) ([]*model.Memory, error) {
+	day := time.Now()
+	if date != "" {
+		var err error
+		if day, err = time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+		}
+	}
+	if windowDays < 0 || windowDays > maxMemoryWindowDays {
+		return nil, fmt.Errorf("windowDays must be between 0 and %d", maxMemoryWindowDays)
+	}
+	if limit < 1 {
+		return nil, errors.New("limit must be at least 1")
+	}
+
+	return db.Memories(user, day, windowDays, limit)
+}
+
 func newConnectionResult(nodeType *graphql.Object) *graphql.Object {
 	return graphql.NewObject(graphql.ObjectConfig{
 		Name: fmt.Sprintf("%sConnectionResult", nodeType.Name()),
@@ -196,18 +456,32 @@ func newConnectionResult(nodeType *graphql.Object) *graphql.Object {
 				Type: graphql.NewObject(graphql.ObjectConfig{
 					Name: "pageInfo",
 					Fields: graphql.Fields{
+						"startCursor": &graphql.Field{
+							Type: graphql.String,
+							Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+								result := params.Source.(*Result)
+								return result.StartCursor, nil
+							},
+						},
 						"endCursor": &graphql.Field{
 							Type: graphql.String,
 							Resolve: func(params graphql.ResolveParams) (interface{}, error) {
 								result := params.Source.(*Result)
-								return result.LastCursor, nil
+								return result.EndCursor, nil
+							},
+						},
+						"hasPreviousPage": &graphql.Field{
+							Type: graphql.Boolean,
+							Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+								result := params.Source.(*Result)
+								return result.HasPreviousPage, nil
 							},
 						},
 						"hasNextPage": &graphql.Field{
 							Type: graphql.Boolean,
 							Resolve: func(params graphql.ResolveParams) (interface{}, error) {
 								result := params.Source.(*Result)
-								return result.HasMore, nil
+								return result.HasNextPage, nil
 							},
 						},
 					},
@@ -220,7 +494,7 @@ func newConnectionResult(nodeType *graphql.Object) *graphql.Object {
 	})
 }
 
-func newSchema() graphql.Schema {
+func newSchema(mutations *graphql.Object) graphql.Schema {
 	schema, err := graphql.NewSchema(graphql.SchemaConfig{
 		Query: graphql.NewObject(
 			graphql.ObjectConfig{
@@ -231,7 +505,139 @@ func newSchema() graphql.Schema {
 						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
 							db := params.Context.Value(model.CtxDB).(*datasource.Database)
 
-							return db.SkeletonMetaData()
+							return db.SkeletonMetaData(model.UserFromContext(params.Context))
+						},
+					},
+
+					// Splits the timeline by year, month, day or event. Events
+					// are photos taken no more than gapHours apart. Only the
+					// photos matching the filter are counted and listed.
+					"buckets": &graphql.Field{
+						Type: graphql.NewList(bucketType),
+						Args: withStateFilterArgs(graphql.FieldConfigArgument{
+							"granularity": &graphql.ArgumentConfig{
+								Type:         granularityType,
+								DefaultValue: model.GranularityMonth,
+							},
+							"gapHours": &graphql.ArgumentConfig{
+								Type:         graphql.Int,
+								DefaultValue: 6,
+							},
+						}),
+						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+							granularity := params.Args["granularity"].(model.Granularity)
+							gapHours := params.Args["gapHours"].(int)
+							if gapHours < 1 {
+								return nil, fmt.Errorf("gapHours must be at least 1, not %d", gapHours)
+							}
+							filter, err := filterFromArgs(params.Args)
+							if err != nil {
+								return nil, err
+							}
+
+							db := params.Context.Value(model.CtxDB).(*datasource.Database)
+
+							return db.Buckets(model.UserFromContext(params.Context), filter, granularity, time.Duration(gapHours)*time.Hour)
+						},
+					},
+
+					// Photos from around this day of the year in earlier years,
+					// grouped by year. limit caps the photos for each year.
+					"onThisDay": &graphql.Field{
+						Type: graphql.NewList(memoryType),
+						Args: graphql.FieldConfigArgument{
+							"date": &graphql.ArgumentConfig{
+								Type:         graphql.String,
+								DefaultValue: "",
+							},
+							"windowDays": &graphql.ArgumentConfig{
+								Type:         graphql.Int,
+								DefaultValue: 0,
+							},
+							"limit": &graphql.ArgumentConfig{
+								Type:         graphql.Int,
+								DefaultValue: 20,
+							},
+						},
+						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+							db := params.Context.Value(model.CtxDB).(*datasource.Database)
+
+							return onThisDay(db, model.UserFromContext(params.Context), params.Args["date"].(string), params.Args["windowDays"].(int), params.Args["limit"].(int))
+						},
+					},
+
+					// Visible photos in a random order that stays the same for
+					// a seed. Without a seed, one is picked and returned.
+					"shuffle": &graphql.Field{
+						Type: shufflePageType,
+						Args: shuffleArgs,
+						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+							seed, ok := params.Args["seed"].(int)
+							if !ok {
+								seed = RandomSeed()
+							}
+							filter, err := filterFromArgs(params.Args)
+							if err != nil {
+								return nil, err
+							}
+
+							db := params.Context.Value(model.CtxDB).(*datasource.Database)
+
+							return shuffle(db, model.UserFromContext(params.Context), seed, filter, params.Args["first"].(int), params.Args["after"].(string))
+						},
+					},
+
+					// Every tag on a visible photo, by name.
+					"tags": &graphql.Field{
+						Type: graphql.NewList(tagType),
+						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+							db := params.Context.Value(model.CtxDB).(*datasource.Database)
+
+							return db.Tags(model.UserFromContext(params.Context))
+						},
+					},
+
+					"tag": &graphql.Field{
+						Type: tagType,
+						Args: graphql.FieldConfigArgument{
+							"name": &graphql.ArgumentConfig{
+								Type: graphql.NewNonNull(graphql.String),
+							},
+						},
+						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+							db := params.Context.Value(model.CtxDB).(*datasource.Database)
+
+							return db.Tag(model.UserFromContext(params.Context), params.Args["name"].(string))
+						},
+					},
+
+					"bucket": &graphql.Field{
+						Type: bucketType,
+						Args: withStateFilterArgs(graphql.FieldConfigArgument{
+							"id": &graphql.ArgumentConfig{
+								Type: graphql.NewNonNull(graphql.String),
+							},
+						}),
+						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+							id := params.Args["id"].(string)
+							filter, err := filterFromArgs(params.Args)
+							if err != nil {
+								return nil, err
+							}
+							if *filter == (model.PhotoFilter{}) {
+								return load(params.Context, loadersFromContext(params.Context).buckets, id), nil
+							}
+
+							// Only unfiltered buckets are batched.
+							db := params.Context.Value(model.CtxDB).(*datasource.Database)
+							buckets, err := db.BucketsForIds(model.UserFromContext(params.Context), filter, id)
+							if err != nil {
+								return nil, err
+							}
+							if buckets[0] == nil {
+								return nil, datasource.ErrInvalidBucket
+							}
+							return buckets[0], nil
 						},
 					},
 
@@ -240,21 +646,48 @@ func newSchema() graphql.Schema {
 						Args: graphql.FieldConfigArgument{
 							"id": &graphql.ArgumentConfig{
 								Type:         graphql.String,
-								DefaultValue: 0,
+								DefaultValue: "",
 							},
 						},
 						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
-							id := params.Args["id"].(string)
-							keys := dataloader.NewKeysFromStrings([]string{id})
-							thunk := yearMonthBucketLoader.Load(params.Context, keys[0])
-							return func() (interface{}, error) {
-								return thunk()
-							}, nil
+							id, _ := params.Args["id"].(string)
+							return load(params.Context, loadersFromContext(params.Context).yearMonthBuckets, id), nil
+						},
+					},
+
+					// Photos hidden for everyone, for admins to unhide.
+					"hiddenPhotos": &graphql.Field{
+						Type: photosConnectionType,
+						Args: connectionArgs,
+						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+							if err := requireAdmin(params.Context); err != nil {
+								return nil, err
+							}
+							db := params.Context.Value(model.CtxDB).(*datasource.Database)
+							return photosConnection(params, func(db *datasource.Database, user string, page *model.Page) (*model.PhotoPage, error) {
+								return db.HiddenPhotos(page)
+							}, func() (interface{}, error) {
+								return db.HiddenPhotosCount()
+							})
+						},
+					},
+
+					"photo": &graphql.Field{
+						Type: photoType,
+						Args: graphql.FieldConfigArgument{
+							"uuid": &graphql.ArgumentConfig{
+								Type: graphql.NewNonNull(graphql.String),
+							},
+						},
+						Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+							uuid := params.Args["uuid"].(string)
+							return load(params.Context, loadersFromContext(params.Context).photos, uuid), nil
 						},
 					},
 				},
 			},
 		),
+		Mutation: mutations,
 	})
 	if err != nil {
 		log.WithError(err).Fatal("failed to create new schema")
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+
+	"github.com/graph-gophers/dataloader"
+	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/model"
+)
+
+// ctxLoaders is the context key for the loaders of the current request.
+const ctxLoaders model.ContextKey = "loaders"
+
+// loaders batch the lookups made while resolving a single GraphQL request.
+// They are created for every request, so their caches never serve data from an
+// earlier request (or another user). Buckets, counts and photos only include
+// photos visible to the user. Admins may also load photos hidden for everyone.
+type loaders struct {
+	yearMonthBuckets *dataloader.Loader
+	buckets          *dataloader.Loader
+	photoCounts      *dataloader.Loader
+	photos           *dataloader.Loader
+	photoUserStates  *dataloader.Loader
+	photoTags        *dataloader.Loader
+}
+
+func newLoaders(db *datasource.Database, user string, role model.Role) *loaders {
+	return &loaders{
+		// Keyed by YYYY-MM.
+		yearMonthBuckets: dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+			log.Debugf("[graphql:yearMonthBucketsLoader]: %q", keys.Keys())
+
+			buckets, err := db.DateBucketsForIds(user, keys.Keys()...)
+			if err != nil {
+				return errorResults(len(keys), err)
+			}
+
+			results := make([]*dataloader.Result, len(buckets))
+			for index, bucket := range buckets {
+				results[index] = &dataloader.Result{Data: bucket}
+			}
+			return results
+		}),
+		// Keyed by bucket ID.
+		buckets: dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+			log.Debugf("[graphql:bucketsLoader]: %q", keys.Keys())
+
+			buckets, err := db.BucketsForIds(user, nil, keys.Keys()...)
+			if err != nil {
+				return errorResults(len(keys), err)
+			}
+
+			results := make([]*dataloader.Result, len(buckets))
+			for index, bucket := range buckets {
+				if bucket == nil {
+					results[index] = &dataloader.Result{Error: datasource.ErrInvalidBucket}
+					continue
+				}
+				results[index] = &dataloader.Result{Data: bucket}
+			}
+			return results
+		}),
+		// Keyed by YYYY-MM.
+		photoCounts: dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+			log.Debugf("[graphql:photoCountsLoader]: %q", keys.Keys())
+
+			counts, err := db.PhotosCounts(user, keys.Keys()...)
+			if err != nil {
+				return errorResults(len(keys), err)
+			}
+
+			results := make([]*dataloader.Result, len(counts))
+			for index, count := range counts {
+				results[index] = &dataloader.Result{Data: count}
+			}
+			return results
+		}),
+		// Keyed by UUID.
+		photos: dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+			log.Debugf("[graphql:photosLoader]: %q", keys.Keys())
+
+			getPhotos := func(uuids ...string) ([]*model.Photo, error) {
+				return db.VisiblePhotos(user, uuids...)
+			}
+			if role == model.RoleAdmin {
+				getPhotos = db.GetPhotos
+			}
+			photos, err := getPhotos(keys.Keys()...)
+			if err != nil {
+				return errorResults(len(keys), err)
+			}
+
+			results := make([]*dataloader.Result, len(photos))
+			for index, photo := range photos {
+				if photo == nil {
+					results[index] = &dataloader.Result{Error: datasource.ErrNotFound}
+					continue
+				}
+				results[index] = &dataloader.Result{Data: photo}
+			}
+			return results
+		}),
+		// Keyed by UUID.
+		photoUserStates: dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+			log.Debugf("[graphql:photoUserStatesLoader]: %q", keys.Keys())
+
+			states, err := db.PhotoUserStates(user, keys.Keys()...)
+			if err != nil {
+				return errorResults(len(keys), err)
+			}
+
+			results := make([]*dataloader.Result, len(states))
+			for index, state := range states {
+				results[index] = &dataloader.Result{Data: state}
+			}
+			return results
+		}),
+		// Keyed by UUID.
+		photoTags: dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+			log.Debugf("[graphql:photoTagsLoader]: %q", keys.Keys())
+
+			tags, err := db.PhotoTags(keys.Keys()...)
+			if err != nil {
+				return errorResults(len(keys), err)
+			}
+
+			results := make([]*dataloader.Result, len(tags))
+			for index, names := range tags {
+				results[index] = &dataloader.Result{Data: names}
+			}
+			return results
+		}),
+	}
+}
+
+// errorResults fails every key in a batch. The dataloader requires exactly one
+// result per key.
+func errorResults(count int, err error) []*dataloader.Result {
+	results := make([]*dataloader.Result, count)
+	for index := range results {
+		results[index] = &dataloader.Result{Error: err}
+	}
+	return results
+}
+
+func loadersFromContext(ctx context.Context) *loaders {
+	return ctx.Value(ctxLoaders).(*loaders)
+}
+
+// load resolves to the value for the key once the loader's batch has run.
+func load(ctx context.Context, loader *dataloader.Loader, key string) func() (interface{}, error) {
+	thunk := loader.Load(ctx, dataloader.StringKey(key))
+	return func() (interface{}, error) {
+		return thunk()
+	}
+}
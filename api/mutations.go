@@ -0,0 +1,302 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/events"
+	"github.com/williamhaley/photo-server/model"
+	"github.com/williamhaley/photo-server/thumbnail"
+)
+
+// errForbidden is returned when the user's role does not allow a mutation.
+var errForbidden = errors.New("forbidden")
+
+// requireAdmin checks that the authenticated user may manage the library.
+func requireAdmin(ctx context.Context) error {
+	if model.RoleFromContext(ctx) != model.RoleAdmin {
+		return errForbidden
+	}
+	return nil
+}
+
+// uuidArgs are the arguments of every mutation on a single photo.
+var uuidArgs = graphql.FieldConfigArgument{
+	"uuid": &graphql.ArgumentConfig{
+		Type: graphql.NewNonNull(graphql.String),
+	},
+}
+
+// withUUIDArgs adds the uuid argument to other arguments.
+func withUUIDArgs(args graphql.FieldConfigArgument) graphql.FieldConfigArgument {
+	for name, arg := range uuidArgs {
+		args[name] = arg
+	}
+	return args
+}
+
+// maxTagSelection limits how many photos may be tagged at once.
+const maxTagSelection = 1000
+
+// tagArgs are the arguments of the mutations tagging a selection of photos.
+var tagArgs = graphql.FieldConfigArgument{
+	"uuids": &graphql.ArgumentConfig{
+		Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+	},
+	"tags": &graphql.ArgumentConfig{
+		Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+	},
+}
+
+// tagMutation wraps a change to the tags of a selection of photos with the
+// admin check and responds with the photos.
+func (api *API) tagMutation(mutate func(uuids, tags []string) error) *graphql.Field {
+	return &graphql.Field{
+		Type: graphql.NewList(photoType),
+		Args: tagArgs,
+		Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+			if err := requireAdmin(params.Context); err != nil {
+				return nil, err
+			}
+			uuids := stringList(params.Args["uuids"])
+			if len(uuids) > maxTagSelection {
+				return nil, fmt.Errorf("at most %d photos may be tagged at once", maxTagSelection)
+			}
+			var tags []string
+			for _, tag := range stringList(params.Args["tags"]) {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					tags = append(tags, tag)
+				}
+			}
+			if len(tags) == 0 {
+				return nil, errors.New("no tags")
+			}
+
+			photos, err := api.db.GetPhotos(uuids...)
+			if err != nil {
+				return nil, err
+			}
+			for _, photo := range photos {
+				if photo == nil {
+					return nil, datasource.ErrNotFound
+				}
+			}
+			if err := mutate(uuids, tags); err != nil {
+				return nil, err
+			}
+			return photos, nil
+		},
+	}
+}
+
+// stringList converts a GraphQL list argument.
+func stringList(arg interface{}) []string {
+	values := arg.([]interface{})
+	list := make([]string, len(values))
+	for index, value := range values {
+		list[index] = value.(string)
+	}
+	return list
+}
+
+// photoMutation wraps a change to a single photo with the admin check,
+// publishes the updated photo as an event of the given type and responds with
+// it.
+func (api *API) photoMutation(eventType string, args graphql.FieldConfigArgument, mutate func(params graphql.ResolveParams, uuid string) error) *graphql.Field {
+	return &graphql.Field{
+		Type: photoType,
+		Args: args,
+		Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+			if err := requireAdmin(params.Context); err != nil {
+				return nil, err
+			}
+			uuid := params.Args["uuid"].(string)
+			if err := mutate(params, uuid); err != nil {
+				return nil, err
+			}
+			photo, err := api.db.GetPhoto(uuid)
+			if err != nil {
+				return nil, err
+			}
+			api.events.Publish(eventType, events.NewPhoto(photo))
+			return photo, nil
+		},
+	}
+}
+
+func (api *API) mutations() *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: "RootMutation",
+		Fields: graphql.Fields{
+			"hidePhoto": api.photoMutation(events.PhotoUpdated, uuidArgs, func(params graphql.ResolveParams, uuid string) error {
+				return api.db.SetPhotoHidden(uuid, true)
+			}),
+
+			// Added back to the timeline, as far as the UI is concerned.
+			"unhidePhoto": api.photoMutation(events.PhotoAdded, uuidArgs, func(params graphql.ResolveParams, uuid string) error {
+				return api.db.SetPhotoHidden(uuid, false)
+			}),
+
+			"setCaption": api.photoMutation(events.PhotoUpdated, withUUIDArgs(graphql.FieldConfigArgument{
+				"caption": &graphql.ArgumentConfig{
+					Type: graphql.NewNonNull(graphql.String),
+				},
+			}), func(params graphql.ResolveParams, uuid string) error {
+				return api.db.SetPhotoCaption(uuid, params.Args["caption"].(string))
+			}),
+
+			// Rotates clockwise by a multiple of 90 degrees. Negative degrees
+			// rotate counter-clockwise. The original file is not modified.
+			"rotatePhoto": api.photoMutation(events.PhotoUpdated, withUUIDArgs(graphql.FieldConfigArgument{
+				"degrees": &graphql.ArgumentConfig{
+					Type: graphql.NewNonNull(graphql.Int),
+				},
+			}), func(params graphql.ResolveParams, uuid string) error {
+				photo, err := api.db.GetPhoto(uuid)
+				if err != nil {
+					return err
+				}
+				orientation, err := thumbnail.RotateOrientation(photo.Orientation, params.Args["degrees"].(int))
+				if err != nil {
+					return err
+				}
+				if err := api.db.SetPhotoOrientation(uuid, orientation); err != nil {
+					return err
+				}
+				photo.Orientation = orientation
+
+				if err := api.thumbnailManager.Invalidate(photo); err != nil {
+					return err
+				}
+				// Regenerate the smallest rendition now, which also updates
+				// the placeholder (the aspect ratio may have flipped). Others
+				// are generated when next requested.
+				file, _, err := api.thumbnailManager.Generate(photo, api.thumbnailManager.DefaultSize(), thumbnail.FormatJPEG, true)
+				if err != nil {
+					log.WithError(err).Errorf("error regenerating thumbnail of rotated photo %q", uuid)
+					return nil
+				}
+				return file.Close()
+			}),
+
+			// Marks the photo for the authenticated user only, so any role may
+			// do it. Arguments left out keep their current value.
+			"setPhotoUserState": &graphql.Field{
+				Type: photoType,
+				Args: withUUIDArgs(graphql.FieldConfigArgument{
+					"favorite": &graphql.ArgumentConfig{
+						Type: graphql.Boolean,
+					},
+					"rating": &graphql.ArgumentConfig{
+						Type: graphql.Int,
+					},
+					"hidden": &graphql.ArgumentConfig{
+						Type: graphql.Boolean,
+					},
+				}),
+				Resolve: api.setPhotoUserState,
+			},
+
+			// Kept for clients from before favorites were kept for each
+			// user. Same as setPhotoUserState with only favorite.
+			"setFavorite": &graphql.Field{
+				Type: photoType,
+				Args: withUUIDArgs(graphql.FieldConfigArgument{
+					"favorite": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.Boolean),
+					},
+				}),
+				Resolve: api.setPhotoUserState,
+			},
+
+			// Tags every photo in the selection with every tag, creating tags
+			// as needed.
+			"addTags": api.tagMutation(api.db.AddTags),
+
+			// Removes every tag from every photo in the selection.
+			"removeTags": api.tagMutation(api.db.RemoveTags),
+
+			// Moves the photo to the trash directory, inside the photos
+			// directory, and removes it from the library. The photo as it was
+			// before being deleted is returned.
+			"deletePhoto": &graphql.Field{
+				Type: photoType,
+				Args: uuidArgs,
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if err := requireAdmin(params.Context); err != nil {
+						return nil, err
+					}
+					photo, err := api.db.GetPhoto(params.Args["uuid"].(string))
+					if err != nil {
+						return nil, err
+					}
+					if err := api.indexer.Trash(photo); err != nil {
+						return nil, err
+					}
+					return photo, nil
+				},
+			},
+
+			// Starts indexing new photos in a folder, relative to the photos
+			// directory, and forgetting removed ones. Returns once the scan has
+			// started.
+			"reindexFolder": &graphql.Field{
+				Type: graphql.Boolean,
+				Args: graphql.FieldConfigArgument{
+					"path": &graphql.ArgumentConfig{
+						Type: graphql.NewNonNull(graphql.String),
+					},
+				},
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					if err := requireAdmin(params.Context); err != nil {
+						return nil, err
+					}
+					if err := api.indexer.StartScanDirectory(params.Args["path"].(string)); err != nil {
+						return nil, err
+					}
+					return true, nil
+				},
+			},
+		},
+	})
+}
+
+// setPhotoUserState resolves setPhotoUserState and setFavorite for the
+// authenticated user. Arguments left out keep their current value.
+func (api *API) setPhotoUserState(params graphql.ResolveParams) (interface{}, error) {
+	photo, err := api.db.GetPhoto(params.Args["uuid"].(string))
+	if err != nil {
+		return nil, err
+	}
+	// Only admins see the photos hidden for everyone.
+	if photo.Hidden && model.RoleFromContext(params.Context) != model.RoleAdmin {
+		return nil, datasource.ErrNotFound
+	}
+	user := model.UserFromContext(params.Context)
+	states, err := api.db.PhotoUserStates(user, photo.UUID)
+	if err != nil {
+		return nil, err
+	}
+	state := states[0]
+	if favorite, ok := params.Args["favorite"].(bool); ok {
+		state.Favorite = favorite
+	}
+	if rating, ok := params.Args["rating"].(int); ok {
+		if rating < 0 || rating > model.MaxRating {
+			return nil, fmt.Errorf("rating must be between 0 and %d", model.MaxRating)
+		}
+		state.Rating = rating
+	}
+	if hidden, ok := params.Args["hidden"].(bool); ok {
+		state.Hidden = hidden
+	}
+	if err := api.db.SetPhotoUserState(user, state); err != nil {
+		return nil, err
+	}
+	return photo, nil
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/graphql-go/graphql"
+	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/model"
+)
+
+// ShufflePage is a page of photos in a random order. The order only depends
+// on the seed, so paging with the same seed is stable. Photos added or removed
+// in the meantime do not move the others.
+type ShufflePage struct {
+	Seed        int      `json:"seed"`
+	UUIDs       []string `json:"uuids"`
+	TotalCount  int      `json:"totalCount"`
+	EndCursor   string   `json:"endCursor"`
+	HasNextPage bool     `json:"hasNextPage"`
+}
+
+// ErrInvalidArgument matches, with errors.Is, the errors of a shuffle caused by
+// its arguments rather than the shuffle failing.
+var ErrInvalidArgument = errors.New("invalid argument")
+
+// argumentError is an error caused by an argument. Its message is the original
+// error's.
+type argumentError struct {
+	error
+}
+
+func (e argumentError) Is(target error) bool {
+	return target == ErrInvalidArgument
+}
+
+func (e argumentError) Unwrap() error {
+	return e.error
+}
+
+// maxShufflePageSize limits how many photos are returned at once.
+const maxShufflePageSize = 1000
+
+var shufflePageType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "shufflePage",
+	Fields: graphql.Fields{
+		"seed": &graphql.Field{
+			Type: graphql.Int,
+		},
+		"uuids": &graphql.Field{
+			Type: graphql.NewList(graphql.String),
+		},
+		"totalCount": &graphql.Field{
+			Type: graphql.Int,
+		},
+		"endCursor": &graphql.Field{
+			Type: graphql.String,
+		},
+		"hasNextPage": &graphql.Field{
+			Type: graphql.Boolean,
+		},
+	},
+})
+
+// shuffleArgs are the arguments of the shuffle query. from and to are
+// inclusive dates, as YYYY-MM-DD.
+var shuffleArgs = withStateFilterArgs(graphql.FieldConfigArgument{
+	"seed": &graphql.ArgumentConfig{
+		Type: graphql.Int,
+	},
+	"first": &graphql.ArgumentConfig{
+		Type:         graphql.Int,
+		DefaultValue: 20,
+	},
+	"after": &graphql.ArgumentConfig{
+		Type:         graphql.String,
+		DefaultValue: "",
+	},
+	"folder": &graphql.ArgumentConfig{
+		Type:         graphql.String,
+		DefaultValue: "",
+	},
+	"from": &graphql.ArgumentConfig{
+		Type:         graphql.String,
+		DefaultValue: "",
+	},
+	"to": &graphql.ArgumentConfig{
+		Type:         graphql.String,
+		DefaultValue: "",
+	},
+})
+
+// RandomSeed picks a seed for a new shuffle. Seeds fit in a GraphQL Int.
+func RandomSeed() int {
+	return int(rand.New(rand.NewSource(time.Now().UnixNano())).Int31())
+}
+
+// shuffle returns the first photos after the cursor in the seed's order.
+func shuffle(db *datasource.Database, user string, seed int, filter *model.PhotoFilter, first int, after string) (*ShufflePage, error) {
+	if first < 1 || first > maxShufflePageSize {
+		return nil, argumentError{fmt.Errorf("first must be between 1 and %d", maxShufflePageSize)}
+	}
+	if err := checkFilter(filter); err != nil {
+		return nil, argumentError{err}
+	}
+
+	var afterUUID string
+	if after != "" {
+		var err error
+		if afterUUID, err = decodeShuffleCursor(after); err != nil {
+			return nil, argumentError{err}
+		}
+	}
+
+	uuids, hasMore, err := db.ShuffledPhotoUUIDs(user, filter, seed, afterUUID, first)
+	if err != nil {
+		return nil, err
+	}
+	count, err := db.CountPhotos(user, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ShufflePage{
+		Seed:        seed,
+		UUIDs:       uuids,
+		TotalCount:  count,
+		HasNextPage: hasMore,
+	}
+	if len(uuids) > 0 {
+		page.EndCursor = EncodeShuffleCursor(uuids[len(uuids)-1])
+	}
+	return page, nil
+}
+
+// EncodeShuffleCursor returns the cursor for the photos after this one.
+// Shuffle cursors are the UUID of the last photo on the page.
+func EncodeShuffleCursor(uuid string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(uuid))
+}
+
+func decodeShuffleCursor(cursor string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", model.ErrInvalidCursor
+	}
+	if _, err := uuid.Parse(string(decoded)); err != nil {
+		return "", model.ErrInvalidCursor
+	}
+	return string(decoded), nil
+}
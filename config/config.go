@@ -0,0 +1,511 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/williamhaley/photo-server/thumbnail"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is prepended to the upper-cased option name (with dashes as
+// underscores) to find the environment variable for an option. For example,
+// -photos-directory may be set with PHOTO_SERVER_PHOTOS_DIRECTORY.
+const EnvPrefix = "PHOTO_SERVER_"
+
+const redacted = "REDACTED"
+
+var errorInvalidThumbnailDirectory = fmt.Errorf("-thumbnails-directory must reference a valid directory")
+var errorInvalidPhotosDirectory = fmt.Errorf("-photos-directory must reference a valid directory")
+var errorInvalidDataDirectory = fmt.Errorf("-data-directory must reference a valid directory")
+var errorInvalidCertFilePath = fmt.Errorf("-https-cert-file path must be defined when using HTTPS")
+var errorInvalidCertKeyPath = fmt.Errorf("-https-cert-key path must be defined when using HTTPS")
+var errorInvalidWorkers = fmt.Errorf("-workers must be at least 1")
+var errorInvalidThumbnailWorkers = fmt.Errorf("-thumbnail-workers must be at least 1")
+var errorInvalidUnixSocketMode = fmt.Errorf("-unix-socket-mode must be an octal file mode like 0660")
+var errorUnixSocketWithHTTPS = fmt.Errorf("-unix-socket cannot be combined with -https-port")
+var errorInvalidThumbnailSizes = fmt.Errorf("-thumbnail-sizes must be a comma separated list of positive pixel sizes")
+var errorInvalidDisplaySize = fmt.Errorf("-display-size must be a positive pixel size")
+var errorInvalidThumbnailFormats = fmt.Errorf("-thumbnail-formats must be a comma separated list of jpeg or webp")
+var errorInvalidThumbnailBackend = fmt.Errorf("-thumbnail-backend must be one of %s", strings.Join(thumbnail.ThumbnailerNames(), ", "))
+var errorInvalidThumbnailCacheSize = fmt.Errorf("-thumbnail-cache-size must be a number of bytes, optionally with a K, M, G or T suffix, like 2G")
+var errorInvalidThumbnailQuality = fmt.Errorf("-thumbnail-quality must be between 1 and 100")
+var errorInvalidBasePath = fmt.Errorf("-base-path must be an absolute URL path like /photos")
+var errorInvalidTrustedProxies = fmt.Errorf("-trusted-proxies must be a comma separated list of IP addresses or CIDR ranges")
+
+// Config is the effective configuration for any subcommand. Values are
+// resolved with the precedence flag > environment > config file > default.
+type Config struct {
+	PhotosDirectory      string `yaml:"photos-directory"`
+	DataDirectory        string `yaml:"data-directory"`
+	ThumbnailsDirectory  string `yaml:"thumbnails-directory"`
+	GenerateThumbnails   bool   `yaml:"thumbnails"`
+	ThumbnailSizes       string `yaml:"thumbnail-sizes"`
+	ThumbnailFormats     string `yaml:"thumbnail-formats"`
+	DisplaySize          int    `yaml:"display-size"`
+	ThumbnailQuality     int    `yaml:"thumbnail-quality"`
+	ThumbnailBackend     string `yaml:"thumbnail-backend"`
+	ThumbnailCacheSize   string `yaml:"thumbnail-cache-size"`
+	OverwriteExisting    bool   `yaml:"overwrite-existing"`
+	Workers              int    `yaml:"workers"`
+	ThumbnailWorkers     int    `yaml:"thumbnail-workers"`
+	BindAddress          string `yaml:"bind-address"`
+	HTTPPort             string `yaml:"http-port"`
+	HTTPSPort            string `yaml:"https-port"`
+	UnixSocketPath       string `yaml:"unix-socket"`
+	UnixSocketMode       string `yaml:"unix-socket-mode"`
+	BasePath             string `yaml:"base-path"`
+	TrustedProxies       string `yaml:"trusted-proxies"`
+	ThumbnailPlaceholder bool   `yaml:"thumbnail-placeholder"`
+	Dev                  bool   `yaml:"dev"`
+	HTTPSCertFilePath    string `yaml:"https-cert-file"`
+	HTTPSCertKeyPath     string `yaml:"https-cert-key"`
+	AccessCode           string `yaml:"access-code"`
+	AdminAccessCode      string `yaml:"admin-access-code"`
+
+	path string
+}
+
+// Default returns the configuration used when nothing else is specified.
+func Default() *Config {
+	return &Config{
+		GenerateThumbnails: true,
+		ThumbnailSizes:     "200,400,1024,2048",
+		ThumbnailFormats:   "webp,jpeg",
+		DisplaySize:        2048,
+		ThumbnailQuality:   85,
+		ThumbnailBackend:   "epeg",
+		Workers:            1,
+		ThumbnailWorkers:   runtime.NumCPU(),
+		HTTPPort:           "8080",
+		UnixSocketMode:     "0660",
+	}
+}
+
+// AllOptions lists every option name that may be passed to NewFlagSet.
+var AllOptions = []string{
+	"photos-directory",
+	"data-directory",
+	"thumbnails-directory",
+	"thumbnails",
+	"thumbnail-sizes",
+	"thumbnail-formats",
+	"thumbnail-quality",
+	"thumbnail-backend",
+	"thumbnail-cache-size",
+	"display-size",
+	"overwrite-existing",
+	"workers",
+	"thumbnail-workers",
+	"bind-address",
+	"http-port",
+	"https-port",
+	"unix-socket",
+	"unix-socket-mode",
+	"base-path",
+	"trusted-proxies",
+	"thumbnail-placeholder",
+	"dev",
+	"https-cert-file",
+	"https-cert-key",
+	"access-code",
+	"admin-access-code",
+}
+
+// NewFlagSet returns a flag set for a subcommand with the named options bound
+// to the config's fields. A -config flag is always registered.
+func (c *Config) NewFlagSet(command string, options ...string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(command, flag.ExitOnError)
+	flagSet.StringVar(&c.path, "config", "", "Path to a YAML configuration file")
+
+	for _, option := range options {
+		switch option {
+		case "photos-directory":
+			flagSet.StringVar(&c.PhotosDirectory, option, c.PhotosDirectory, "Root directory for all photos")
+		case "data-directory":
+			flagSet.StringVar(&c.DataDirectory, option, c.DataDirectory, "Directory to store application data")
+		case "thumbnails-directory":
+			flagSet.StringVar(&c.ThumbnailsDirectory, option, c.ThumbnailsDirectory, "Directory to use for thumbnails")
+		case "thumbnails":
+			flagSet.BoolVar(&c.GenerateThumbnails, option, c.GenerateThumbnails, "Whether or not to generate thumbnails while indexing")
+		case "thumbnail-sizes":
+			flagSet.StringVar(&c.ThumbnailSizes, option, c.ThumbnailSizes, "Comma separated maximum pixel sizes of the thumbnail renditions")
+		case "thumbnail-formats":
+			flagSet.StringVar(&c.ThumbnailFormats, option, c.ThumbnailFormats, "Comma separated thumbnail formats, in order of preference. JPEG is always generated")
+		case "thumbnail-quality":
+			flagSet.IntVar(&c.ThumbnailQuality, option, c.ThumbnailQuality, "JPEG quality of thumbnails, 1-100")
+		case "thumbnail-backend":
+			flagSet.StringVar(&c.ThumbnailBackend, option, c.ThumbnailBackend, "Thumbnail backend, one of "+strings.Join(thumbnail.ThumbnailerNames(), ", "))
+		case "thumbnail-cache-size":
+			flagSet.StringVar(&c.ThumbnailCacheSize, option, c.ThumbnailCacheSize, "Maximum total size of all thumbnails, like 2G. The least recently used are evicted. Defaults to unlimited")
+		case "display-size":
+			flagSet.IntVar(&c.DisplaySize, option, c.DisplaySize, "Maximum pixel size of the rendition used to view a single photo")
+		case "overwrite-existing":
+			flagSet.BoolVar(&c.OverwriteExisting, option, c.OverwriteExisting, "Whether or not to clobber existing thumbnails")
+		case "workers":
+			flagSet.IntVar(&c.Workers, option, c.Workers, "Number of workers to run concurrently")
+		case "thumbnail-workers":
+			flagSet.IntVar(&c.ThumbnailWorkers, option, c.ThumbnailWorkers, "Maximum number of thumbnails to generate on demand at once")
+		case "bind-address":
+			flagSet.StringVar(&c.BindAddress, option, c.BindAddress, "Address to bind, e.g. 127.0.0.1. Defaults to all interfaces")
+		case "http-port":
+			flagSet.StringVar(&c.HTTPPort, option, c.HTTPPort, "Port to serve the app over HTTP")
+		case "https-port":
+			flagSet.StringVar(&c.HTTPSPort, option, c.HTTPSPort, "Port to serve the app over HTTPS")
+		case "unix-socket":
+			flagSet.StringVar(&c.UnixSocketPath, option, c.UnixSocketPath, "Path of a Unix domain socket to serve the app over instead of the HTTP port")
+		case "unix-socket-mode":
+			flagSet.StringVar(&c.UnixSocketMode, option, c.UnixSocketMode, "Octal file permissions for the Unix domain socket")
+		case "base-path":
+			flagSet.StringVar(&c.BasePath, option, c.BasePath, "URL path prefix the app is served under, e.g. /photos")
+		case "trusted-proxies":
+			flagSet.StringVar(&c.TrustedProxies, option, c.TrustedProxies, "Comma separated IPs or CIDR ranges of reverse proxies whose X-Forwarded-* headers are trusted")
+		case "dev":
+			flagSet.BoolVar(&c.Dev, option, c.Dev, "Enable development tools, like GraphiQL at /graphql")
+		case "thumbnail-placeholder":
+			flagSet.BoolVar(&c.ThumbnailPlaceholder, option, c.ThumbnailPlaceholder, "Respond with a placeholder image when a thumbnail cannot be served")
+		case "https-cert-file":
+			flagSet.StringVar(&c.HTTPSCertFilePath, option, c.HTTPSCertFilePath, "Path where HTTPS certificate can be found")
+		case "https-cert-key":
+			flagSet.StringVar(&c.HTTPSCertKeyPath, option, c.HTTPSCertKeyPath, "Path where HTTPS certificate key can be found")
+		case "access-code":
+			flagSet.StringVar(&c.AccessCode, option, c.AccessCode, "Access code users will need to access the server")
+		case "admin-access-code":
+			flagSet.StringVar(&c.AdminAccessCode, option, c.AdminAccessCode, "Access code for users who may also manage the library. Defaults to no admins")
+		default:
+			panic(fmt.Sprintf("unknown config option %q", option))
+		}
+	}
+
+	return flagSet
+}
+
+// Parse parses the command line arguments and then fills in any option that
+// was not given as a flag from the environment or, failing that, the config
+// file.
+func (c *Config) Parse(flagSet *flag.FlagSet, arguments []string) error {
+	if err := flagSet.Parse(arguments); err != nil {
+		return err
+	}
+
+	explicit := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if !explicit["config"] {
+		c.path = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	fileValues, err := readFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	var setErr error
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if setErr != nil || f.Name == "config" || explicit[f.Name] {
+			return
+		}
+
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if !ok {
+			value, ok = fileValues[f.Name]
+		}
+		if !ok {
+			return
+		}
+		if err := flagSet.Set(f.Name, value); err != nil {
+			setErr = fmt.Errorf("invalid value %q for %s: %w", value, f.Name, err)
+		}
+	})
+	if setErr != nil {
+		return setErr
+	}
+
+	c.PhotosDirectory = os.ExpandEnv(c.PhotosDirectory)
+	c.DataDirectory = os.ExpandEnv(c.DataDirectory)
+	c.ThumbnailsDirectory = os.ExpandEnv(c.ThumbnailsDirectory)
+	c.UnixSocketPath = os.ExpandEnv(c.UnixSocketPath)
+	c.HTTPSCertFilePath = os.ExpandEnv(c.HTTPSCertFilePath)
+	c.HTTPSCertKeyPath = os.ExpandEnv(c.HTTPSCertKeyPath)
+
+	return nil
+}
+
+// EnvName returns the environment variable name for an option.
+func EnvName(option string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+// readFile reads the config file into option/value pairs. Options unknown to
+// any subcommand are rejected so typos do not go unnoticed.
+func readFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %q: %w", path, err)
+	}
+
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(contents, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing config file %q: %w", path, err)
+	}
+
+	known := map[string]bool{}
+	for _, option := range AllOptions {
+		known[option] = true
+	}
+	for key, value := range raw {
+		if !known[key] {
+			return nil, fmt.Errorf("unknown option %q in config file %q", key, path)
+		}
+		if value == nil {
+			continue
+		}
+		// YAML reads an unquoted 0660 as the octal number 432.
+		if mode, ok := value.(int); ok && key == "unix-socket-mode" {
+			values[key] = strconv.FormatInt(int64(mode), 8)
+			continue
+		}
+		values[key] = fmt.Sprint(value)
+	}
+
+	return values, nil
+}
+
+// Validate checks that the options a subcommand relies on are usable.
+func (c *Config) Validate(command string) error {
+	switch command {
+	case "index":
+		if c.PhotosDirectory == "" {
+			return errorInvalidPhotosDirectory
+		}
+		if c.DataDirectory == "" {
+			return errorInvalidDataDirectory
+		}
+		if c.GenerateThumbnails {
+			if err := validateDirectory(c.ThumbnailsDirectory); err != nil {
+				return errorInvalidThumbnailDirectory
+			}
+		}
+	case "thumbnails":
+		if err := validateDirectory(c.ThumbnailsDirectory); err != nil {
+			return errorInvalidThumbnailDirectory
+		}
+		if c.PhotosDirectory == "" {
+			return errorInvalidPhotosDirectory
+		}
+		if c.DataDirectory == "" {
+			return errorInvalidDataDirectory
+		}
+	case "serve":
+		if err := validateDirectory(c.ThumbnailsDirectory); err != nil {
+			return errorInvalidThumbnailDirectory
+		}
+		if c.DataDirectory == "" {
+			return errorInvalidDataDirectory
+		}
+		if c.HTTPSPort != "" {
+			if c.HTTPSCertFilePath == "" {
+				return errorInvalidCertFilePath
+			}
+			if c.HTTPSCertKeyPath == "" {
+				return errorInvalidCertKeyPath
+			}
+			if c.UnixSocketPath != "" {
+				return errorUnixSocketWithHTTPS
+			}
+		}
+		if _, err := c.UnixSocketFileMode(); err != nil {
+			return errorInvalidUnixSocketMode
+		}
+		if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.ContainsAny(c.BasePath, "?#")) {
+			return errorInvalidBasePath
+		}
+		if _, err := c.TrustedProxyNetworks(); err != nil {
+			return errorInvalidTrustedProxies
+		}
+		if c.ThumbnailWorkers < 1 {
+			return errorInvalidThumbnailWorkers
+		}
+	}
+
+	if c.Workers < 1 {
+		return errorInvalidWorkers
+	}
+	if _, err := c.ThumbnailSizeList(); err != nil {
+		return errorInvalidThumbnailSizes
+	}
+	if c.DisplaySize < 1 {
+		return errorInvalidDisplaySize
+	}
+	if _, err := c.ThumbnailFormatList(); err != nil {
+		return errorInvalidThumbnailFormats
+	}
+	if c.ThumbnailQuality < 1 || c.ThumbnailQuality > 100 {
+		return errorInvalidThumbnailQuality
+	}
+	if _, err := thumbnail.NewThumbnailer(c.ThumbnailBackend); err != nil {
+		return errorInvalidThumbnailBackend
+	}
+	if _, err := c.ThumbnailCacheSizeBytes(); err != nil {
+		return errorInvalidThumbnailCacheSize
+	}
+
+	return nil
+}
+
+// UnixSocketFileMode parses the octal Unix domain socket permissions.
+func (c *Config) UnixSocketFileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.UnixSocketMode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// ThumbnailSizeList parses the thumbnail rendition sizes.
+func (c *Config) ThumbnailSizeList() ([]int, error) {
+	sizes := []int{}
+	for _, entry := range strings.Split(c.ThumbnailSizes, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		if size < 1 {
+			return nil, fmt.Errorf("invalid thumbnail size %d", size)
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes, nil
+}
+
+// ThumbnailFormatList parses the thumbnail formats.
+func (c *Config) ThumbnailFormatList() ([]thumbnail.Format, error) {
+	formats := []thumbnail.Format{}
+	for _, entry := range strings.Split(c.ThumbnailFormats, ",") {
+		format, err := thumbnail.ParseFormat(entry)
+		if err != nil {
+			return nil, err
+		}
+		formats = append(formats, format)
+	}
+
+	return formats, nil
+}
+
+// byteUnits are the multipliers for each suffix accepted by
+// ThumbnailCacheSizeBytes.
+var byteUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ThumbnailCacheSizeBytes parses the thumbnail cache budget. A suffix of K, M,
+// G or T (optionally followed by B or iB) is in powers of 1024. An empty value
+// or 0 is unlimited.
+func (c *Config) ThumbnailCacheSizeBytes() (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(c.ThumbnailCacheSize))
+	if value == "" {
+		return 0, nil
+	}
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	number := strings.TrimRight(value, "KMGT")
+	unit, ok := byteUnits[value[len(number):]]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", c.ThumbnailCacheSize)
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("invalid size %q", c.ThumbnailCacheSize)
+	}
+
+	return size * unit, nil
+}
+
+// TrustedProxyNetworks parses the trusted proxies. A bare IP address is
+// treated as a single host range.
+func (c *Config) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range strings.Split(c.TrustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func validateDirectory(path string) error {
+	if path == "" {
+		return fmt.Errorf("no directory specified")
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%q is not a directory", path)
+	}
+
+	return nil
+}
+
+// Print writes the configuration as YAML, suitable for use as a config file,
+// with secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	printable := *c
+	if printable.AccessCode != "" {
+		printable.AccessCode = redacted
+	}
+	if printable.AdminAccessCode != "" {
+		printable.AdminAccessCode = redacted
+	}
+
+	out, err := yaml.Marshal(&printable)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+
+	return err
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setenv sets an environment variable for the rest of the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+
+	previous, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func parse(t *testing.T, arguments ...string) (*Config, error) {
+	t.Helper()
+
+	c := Default()
+	flagSet := c.NewFlagSet("serve", AllOptions...)
+	return c, c.Parse(flagSet, arguments)
+}
+
+func TestParsePrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+workers: 3
+https-port: "8443"
+thumbnails: false
+access-code: secret
+bind-address: 10.0.0.1
+unix-socket-mode: 0600
+`)
+	setenv(t, EnvName("workers"), "5")
+	setenv(t, EnvName("https-port"), "9443")
+
+	c, err := parse(t, "-config", path, "-https-port", "443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		option    string
+		got, want interface{}
+	}{
+		{"flag over environment and file", c.HTTPSPort, "443"},
+		{"environment over file", c.Workers, 5},
+		{"file bool over default", c.GenerateThumbnails, false},
+		{"file string", c.AccessCode, "secret"},
+		{"file listener address", c.BindAddress, "10.0.0.1"},
+		{"unquoted octal in file", c.UnixSocketMode, "600"},
+		{"default", c.HTTPPort, "8080"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %v, want %v", test.option, test.got, test.want)
+		}
+	}
+}
+
+func TestParseConfigFromEnvironment(t *testing.T) {
+	setenv(t, EnvName("config"), writeConfigFile(t, "http-port: 9001\n"))
+	setenv(t, "PHOTOS_ROOT", "/srv/photos")
+	setenv(t, EnvName("photos-directory"), "$PHOTOS_ROOT/library")
+
+	c, err := parse(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTPPort != "9001" {
+		t.Errorf("got port %q from the config file in the environment, want 9001", c.HTTPPort)
+	}
+	if c.PhotosDirectory != "/srv/photos/library" {
+		t.Errorf("got photos directory %q, want the variable expanded", c.PhotosDirectory)
+	}
+
+	// A -config flag wins over the environment.
+	c, err = parse(t, "-config", writeConfigFile(t, "http-port: 9002\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTPPort != "9002" {
+		t.Errorf("got port %q from the config flag, want 9002", c.HTTPPort)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		env       map[string]string
+		wantError string
+	}{
+		{"unknown option in file", "http-prot: 80\n", nil, `unknown option "http-prot"`},
+		{"invalid yaml", "http-port: [\n", nil, "error parsing config file"},
+		{"invalid value in file", "workers: many\n", nil, `invalid value "many" for workers`},
+		{"invalid value in environment", "", map[string]string{EnvName("thumbnails"): "sometimes"}, `invalid value "sometimes" for thumbnails`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				setenv(t, key, value)
+			}
+
+			_, err := parse(t, "-config", writeConfigFile(t, test.file))
+			if err == nil || !strings.Contains(err.Error(), test.wantError) {
+				t.Errorf("got error %v, want %q", err, test.wantError)
+			}
+		})
+	}
+
+	if _, err := parse(t, "-config", filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Error("a missing config file did not fail")
+	}
+}
@@ -1,17 +1,30 @@
 package datasource
 
 import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/Masterminds/squirrel"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3" // Import to initialize driver
+	"github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
 	"github.com/williamhaley/photo-server/model"
 )
 
+// ErrNotFound is returned when a requested record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalidBucket is returned for a bucket ID that is not a year, month, day
+// or event.
+var ErrInvalidBucket = errors.New("invalid bucket")
+
 // Database is the general concept wrapping the organization of photos.
 type Database struct {
 	db   *sqlx.DB
@@ -40,14 +53,27 @@ func New(dataDirectory string) *Database {
 		log.Info("database opened")
 	}
 
+	if err := migrate(db); err != nil {
+		log.WithError(err).Fatalf("failed to migrate db %q", path)
+	}
+
 	return &Database{
 		db: db,
 	}
 }
 
+// Close releases the underlying DB handle.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
 func DestructiveReset(db *sqlx.DB) error {
 	_, err := db.Exec(`
 		DROP TABLE IF EXISTS photos;
+		DROP TABLE IF EXISTS thumbnails;
+		DROP TABLE IF EXISTS photo_user_state;
+		DROP TABLE IF EXISTS tags;
+		DROP TABLE IF EXISTS photo_tags;
 		CREATE TABLE photos (
 			uuid VARCHAR(32) PRIMARY KEY,
 			path VARCHAR(512) NOT NULL,
@@ -58,6 +84,7 @@ func DestructiveReset(db *sqlx.DB) error {
 		);
 		CREATE INDEX year_index ON photos(year);
 		CREATE INDEX month_index ON photos(month);
+		PRAGMA user_version = 0;
 	`)
 
 	// TODO WFH Index on year, others.
@@ -68,9 +95,100 @@ func DestructiveReset(db *sqlx.DB) error {
 	return nil
 }
 
+// migrations upgrade the schema created by DestructiveReset. The DB's
+// user_version tracks how many have been applied. Only ever append to this.
+var migrations = []string{
+	`ALTER TABLE photos ADD COLUMN orientation INTEGER NOT NULL DEFAULT 1;`,
+	`CREATE TABLE thumbnails (
+		path VARCHAR(512) PRIMARY KEY,
+		uuid VARCHAR(32) NOT NULL,
+		bytes INTEGER NOT NULL,
+		last_access INTEGER NOT NULL
+	);
+	CREATE INDEX thumbnails_last_access_index ON thumbnails(last_access);`,
+	`ALTER TABLE photos ADD COLUMN blurhash VARCHAR(64) NOT NULL DEFAULT '';
+	ALTER TABLE photos ADD COLUMN dominant_color VARCHAR(7) NOT NULL DEFAULT '';
+	ALTER TABLE photos ADD COLUMN aspect_ratio REAL NOT NULL DEFAULT 0;`,
+	`ALTER TABLE photos ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT 0;
+	ALTER TABLE photos ADD COLUMN caption TEXT NOT NULL DEFAULT '';
+	ALTER TABLE photos ADD COLUMN favorite BOOLEAN NOT NULL DEFAULT 0;
+	CREATE INDEX path_index ON photos(path);`,
+	`CREATE INDEX date_index ON photos(date);`,
+	`DROP INDEX date_index;
+	CREATE INDEX date_uuid_index ON photos(date, uuid);`,
+	`ALTER TABLE photos ADD COLUMN day INTEGER NOT NULL DEFAULT 0;
+	UPDATE photos SET day = CAST(substr(date, 9, 2) AS INTEGER);
+	CREATE INDEX month_day_index ON photos(month, day);`,
+	`CREATE TABLE photo_user_state (
+		user VARCHAR(64) NOT NULL,
+		photo_uuid VARCHAR(32) NOT NULL,
+		favorite BOOLEAN NOT NULL DEFAULT 0,
+		rating INTEGER NOT NULL DEFAULT 0 CHECK (rating BETWEEN 0 AND 5),
+		hidden BOOLEAN NOT NULL DEFAULT 0,
+		PRIMARY KEY (user, photo_uuid)
+	);`,
+	`CREATE TABLE tags (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		normalized TEXT NOT NULL UNIQUE
+	);
+	CREATE TABLE photo_tags (
+		photo_uuid VARCHAR(32) NOT NULL,
+		tag_id INTEGER NOT NULL,
+		PRIMARY KEY (photo_uuid, tag_id)
+	);
+	CREATE INDEX photo_tags_tag_index ON photo_tags(tag_id);`,
+	// Favorites are kept for each user now. Photos that were favorites for
+	// everyone stay favorites of those logging in without a name. The column
+	// stays, unused, since SQLite cannot drop it.
+	`INSERT INTO photo_user_state (user, photo_uuid, favorite)
+	SELECT '', uuid, 1 FROM photos WHERE favorite
+	ON CONFLICT (user, photo_uuid) DO UPDATE SET favorite = 1;`,
+}
+
+// migrate applies any migrations the DB has not seen yet.
+func migrate(db *sqlx.DB) error {
+	var version int
+	if err := db.Get(&version, "PRAGMA user_version"); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Infof("applied database migration %d", version+1)
+	}
+
+	return nil
+}
+
+// driverName is SQLite with the functions the queries here need.
+const driverName = "sqlite3_photo_server"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("shuffle_key", shuffleKey, true)
+		},
+	})
+}
+
 // MustOpen opens the DB for API access.
 func MustOpen(path string) *sqlx.DB {
-	db, err := sqlx.Connect("sqlite3", path)
+	db, err := sqlx.Connect(driverName, path)
 	if err != nil {
 		log.WithError(err).Fatalf("failed to open db %q", path)
 	}
@@ -78,55 +196,63 @@ func MustOpen(path string) *sqlx.DB {
 	return db
 }
 
-// DateBucketsForIds returns date buckets for each YYYY-MM provided. The results
-// are guaranteed to be sorted in the same order as the request ids.
-func (d *Database) DateBucketsForIds(ids ...string) ([]*model.YearMonthBucket, error) {
-	query := squirrel.
-		Select("year", "month", "uuid", `strftime("%Y-%m-%dT%H:%M:%S:%f", date) || "~" || name || "~" || uuid AS cursor`).
-		From("photos")
+// DateBucketsForIds returns date buckets, with their photo counts, for each
+// YYYY-MM provided. The results are guaranteed to be sorted in the same order
+// as the request ids. A month without photos has a count of 0. Photos hidden
+// by the user are not counted.
+func (d *Database) DateBucketsForIds(user string, ids ...string) ([]*model.YearMonthBucket, error) {
+	buckets := make([]*model.YearMonthBucket, len(ids))
 	or := squirrel.Or{}
-	for _, id := range ids {
-		or = append(or, squirrel.Like{"date": id})
+	for index, id := range ids {
+		var year, month int
+		if _, err := fmt.Sscanf(id, "%d-%d", &year, &month); err != nil {
+			return nil, fmt.Errorf("invalid date bucket %q: %w", id, err)
+		}
+		buckets[index] = &model.YearMonthBucket{
+			Date:  fmt.Sprintf("%04d-%02d", year, month),
+			Year:  year,
+			Month: month,
+		}
+		or = append(or, squirrel.Eq{"year": year, "month": month})
+	}
+	if len(ids) == 0 {
+		return buckets, nil
 	}
-	query.Where(or).OrderBy("cursor desc")
 
-	sql, args, err := query.ToSql()
+	sql, args, err := squirrel.
+		Select("year", "month", "count(*) as total_count").
+		From("photos").
+		Where(or).
+		Where(visibleTo(user)).
+		GroupBy("year", "month").
+		ToSql()
 	if err != nil {
 		log.WithError(err).Error("failed to build query for date buckets")
 		return nil, err
 	}
 
-	var results []*model.Photo = make([]*model.Photo, 0)
-	err = d.db.Select(&results, sql, args...)
+	var counts []*model.YearMonthBucket = make([]*model.YearMonthBucket, 0)
+	err = d.db.Select(&counts, sql, args...)
 	if err != nil {
-		log.WithError(err).Error("failed to query total counts")
+		log.WithError(err).Error("failed to query date buckets")
 		return nil, err
 	}
 
-	asMap := make(map[string]*model.YearMonthBucket, len(results))
-	for _, result := range results {
-		key := fmt.Sprintf("%d-%d", result.Year, result.Month)
-		if _, ok := asMap[key]; !ok {
-			asMap[key] = &model.YearMonthBucket{
-				Year:       result.Year,
-				Month:      result.Month,
-				Date:       key,
-				PhotoUuids: []string{},
+	for _, count := range counts {
+		for _, bucket := range buckets {
+			if bucket.Year == count.Year && bucket.Month == count.Month {
+				bucket.TotalCount = count.TotalCount
 			}
 		}
-		asMap[key].PhotoUuids = append(asMap[key].PhotoUuids, result.UUID)
 	}
 
-	sorted := make([]*model.YearMonthBucket, len(ids))
-	for index, date := range ids {
-		sorted[index] = asMap[date]
-	}
-
-	return sorted, nil
+	return buckets, nil
 }
 
-func (d *Database) SkeletonMetaData() ([]*model.YearMonthBucket, error) {
-	query := squirrel.Select("year", "month", "count(*) as total_count").From("photos").GroupBy("year", "month").OrderBy("year desc", "month desc")
+// SkeletonMetaData returns every month with photos visible to the user, newest
+// first, with their counts.
+func (d *Database) SkeletonMetaData(user string) ([]*model.YearMonthBucket, error) {
+	query := squirrel.Select("year", "month", "count(*) as total_count").From("photos").Where(visibleTo(user)).GroupBy("year", "month").OrderBy("year desc", "month desc")
 	sql, args, err := query.ToSql()
 	if err != nil {
 		log.WithError(err).Error("failed to build query for total counts")
@@ -143,59 +269,524 @@ func (d *Database) SkeletonMetaData() ([]*model.YearMonthBucket, error) {
 	return dateBuckets, nil
 }
 
-// PhotosCount returns the count of all photos for a given yearh and month.
-func (d *Database) PhotosCount(year, month int) (int, error) {
-	var count int
-	err := d.db.Get(&count, "SELECT COUNT(*) FROM photos WHERE year = ? AND month = ?", year, month)
+// calendarGranularities are the granularities of calendar bucket IDs, by
+// length. Calendar IDs are prefixes of the stored dates.
+var calendarGranularities = map[int]model.Granularity{
+	len("2006"):       model.GranularityYear,
+	len("2006-01"):    model.GranularityMonth,
+	len("2006-01-02"): model.GranularityDay,
+}
+
+var calendarLayouts = map[model.Granularity]string{
+	model.GranularityYear:  "2006",
+	model.GranularityMonth: "2006-01",
+	model.GranularityDay:   "2006-01-02",
+}
+
+// eventLayout is the layout of each end of an event bucket ID.
+const eventLayout = "2006-01-02T15:04:05"
+
+// bucketRange returns the granularity of a bucket and the range of stored
+// dates in it, from inclusive to exclusive. Dates are stored as text starting
+// with "2006-01-02 15:04:05", in the photo's own time zone, so the range is
+// compared as text. "~" sorts after any character in a stored date, so every
+// date starting with a prefix is less than the prefix followed by "~".
+func bucketRange(id string) (model.Granularity, string, string, error) {
+	if granularity, ok := calendarGranularities[len(id)]; ok {
+		if _, err := time.Parse(calendarLayouts[granularity], id); err != nil {
+			return "", "", "", ErrInvalidBucket
+		}
+		from := id
+		if granularity == model.GranularityYear {
+			// The date column has numeric affinity, so a bare year would be
+			// compared as a number, which sorts before all text.
+			from += "-"
+		}
+		return granularity, from, id + "~", nil
+	}
+
+	ends := strings.Split(id, "/")
+	if len(ends) != 2 {
+		return "", "", "", ErrInvalidBucket
+	}
+	oldest, err := time.Parse(eventLayout, ends[0])
 	if err != nil {
-		log.WithError(err).Error("failed to query photos")
+		return "", "", "", ErrInvalidBucket
+	}
+	newest, err := time.Parse(eventLayout, ends[1])
+	if err != nil || newest.Before(oldest) {
+		return "", "", "", ErrInvalidBucket
+	}
+	return model.GranularityEvent, strings.Replace(ends[0], "T", " ", 1), strings.Replace(ends[1], "T", " ", 1) + "~", nil
+}
+
+// Buckets splits the timeline into buckets of photos visible to the user
+// matching the filter, newest first. The gap is only used for events: photos
+// further apart than it are in separate events.
+func (d *Database) Buckets(user string, filter *model.PhotoFilter, granularity model.Granularity, gap time.Duration) ([]*model.Bucket, error) {
+	var buckets []*model.Bucket
+	var err error
+	if granularity == model.GranularityEvent {
+		buckets, err = d.eventBuckets(user, filter, gap)
+	} else {
+		buckets, err = d.calendarBuckets(user, filter, granularity)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		bucket.Filter = filter
+	}
+	return buckets, nil
+}
+
+// calendarBuckets groups photos by year, month or day.
+func (d *Database) calendarBuckets(user string, filter *model.PhotoFilter, granularity model.Granularity) ([]*model.Bucket, error) {
+	layout, ok := calendarLayouts[granularity]
+	if !ok {
+		return nil, fmt.Errorf("invalid granularity %q", granularity)
+	}
+
+	sql, args, err := squirrel.
+		Select().
+		Column("substr(date, 1, ?) AS id", len(layout)).
+		Column("count(*) AS total_count").
+		From("photos").
+		Where(matching(user, filter)).
+		GroupBy("id").
+		OrderBy("id DESC").
+		ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for buckets")
+		return nil, err
+	}
+
+	var buckets []*model.Bucket = make([]*model.Bucket, 0)
+	if err := d.db.Select(&buckets, sql, args...); err != nil {
+		log.WithError(err).Error("failed to query buckets")
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		bucket.Granularity = granularity
+	}
+
+	return buckets, nil
+}
+
+// eventBuckets walks every photo, newest first, and starts a new event
+// wherever the time since the previous photo is more than the gap.
+func (d *Database) eventBuckets(user string, filter *model.PhotoFilter, gap time.Duration) ([]*model.Bucket, error) {
+	sql, args, err := squirrel.
+		Select("substr(date, 1, 19)").
+		From("photos").
+		Where(matching(user, filter)).
+		OrderBy("date DESC").
+		ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for photo dates")
+		return nil, err
+	}
+
+	rows, err := d.db.Query(sql, args...)
+	if err != nil {
+		log.WithError(err).Error("failed to query photo dates")
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make([]*model.Bucket, 0)
+	var bucket *model.Bucket
+	var newest, previous time.Time
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			return nil, err
+		}
+		taken, err := time.Parse("2006-01-02 15:04:05", date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid photo date %q: %w", date, err)
+		}
+
+		if bucket == nil || previous.Sub(taken) > gap {
+			bucket = &model.Bucket{Granularity: model.GranularityEvent}
+			buckets = append(buckets, bucket)
+			newest = taken
+		}
+		bucket.TotalCount++
+		bucket.ID = taken.Format(eventLayout) + "/" + newest.Format(eventLayout)
+		previous = taken
+	}
+
+	return buckets, rows.Err()
+}
+
+// BucketsForIds returns the bucket, with its count of photos visible to the
+// user matching the filter, for each ID, in the same order. An invalid ID has
+// a nil entry.
+func (d *Database) BucketsForIds(user string, filter *model.PhotoFilter, ids ...string) ([]*model.Bucket, error) {
+	buckets := make([]*model.Bucket, len(ids))
+
+	matchingSQL, matchingArgs, err := matching(user, filter).ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for bucket counts")
+		return nil, err
+	}
+
+	var queries []string
+	var args []interface{}
+	for index, id := range ids {
+		granularity, from, to, err := bucketRange(id)
+		if err != nil {
+			continue
+		}
+		buckets[index] = &model.Bucket{ID: id, Granularity: granularity, Filter: filter}
+		queries = append(queries, "SELECT ? AS id, count(*) AS total_count FROM photos WHERE "+matchingSQL+" AND date >= ? AND date < ?")
+		args = append(append(append(args, id), matchingArgs...), from, to)
+	}
+	if len(queries) == 0 {
+		return buckets, nil
+	}
+
+	var counts []*model.Bucket = make([]*model.Bucket, 0)
+	err = d.db.Select(&counts, strings.Join(queries, " UNION ALL "), args...)
+	if err != nil {
+		log.WithError(err).Error("failed to query bucket counts")
+		return nil, err
+	}
+
+	for _, count := range counts {
+		for _, bucket := range buckets {
+			if bucket != nil && bucket.ID == count.ID {
+				bucket.TotalCount = count.TotalCount
+			}
+		}
+	}
+
+	return buckets, nil
+}
+
+// PhotosCounts returns the count of photos visible to the user for each
+// YYYY-MM provided, in the same order as the request ids.
+func (d *Database) PhotosCounts(user string, ids ...string) ([]int, error) {
+	buckets, err := d.DateBucketsForIds(user, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int, len(buckets))
+	for index, bucket := range buckets {
+		counts[index] = bucket.TotalCount
+	}
+	return counts, nil
+}
+
+// PhotosInBucket returns a page of the photos in a bucket visible to the user
+// matching the filter, newest first.
+func (d *Database) PhotosInBucket(user, id string, filter *model.PhotoFilter, page *model.Page) (*model.PhotoPage, error) {
+	log.Debugf("[datasource.PhotosInBucket] user:%q id:%q filter:%+v page:%+v", user, id, filter, page)
+
+	_, from, to, err := bucketRange(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.photosPage(append(squirrel.And{
+		squirrel.Expr("date >= ? AND date < ?", from, to),
+	}, matching(user, filter)...), page)
+}
+
+// HiddenPhotos returns a page of the photos hidden for everyone, newest first.
+func (d *Database) HiddenPhotos(page *model.Page) (*model.PhotoPage, error) {
+	return d.photosPage(squirrel.And{squirrel.Expr("hidden")}, page)
+}
+
+// HiddenPhotosCount returns how many photos are hidden for everyone.
+func (d *Database) HiddenPhotosCount() (int, error) {
+	var count int
+	if err := d.db.Get(&count, "SELECT COUNT(*) FROM photos WHERE hidden"); err != nil {
+		log.WithError(err).Error("failed to count hidden photos")
 		return 0, err
 	}
 	return count, nil
 }
 
-// AllPhotos returns all the photos within a given range and whether or not there
-// are more photos after the query.
-func (d *Database) AllPhotos(year, month, limit int, after string) ([]*model.Photo, bool, error) {
-	log.Debugf("[datasource.AllPhotos] year:%d month:%d limit:%d after:%q", year, month, limit, after)
+// PhotosWithTag returns a page of the photos with a tag visible to the user,
+// newest first.
+func (d *Database) PhotosWithTag(user, tag string, page *model.Page) (*model.PhotoPage, error) {
+	log.Debugf("[datasource.PhotosWithTag] user:%q tag:%q page:%+v", user, tag, page)
+
+	return d.photosPage(squirrel.And{
+		squirrel.Expr("uuid IN (SELECT photo_uuid FROM photo_tags JOIN tags ON tags.id = photo_tags.tag_id WHERE tags.normalized = ?)", normalizeTag(tag)),
+		visibleTo(user),
+	}, page)
+}
+
+// photosPage returns a page of the photos matching the condition, newest
+// first.
+func (d *Database) photosPage(matching squirrel.And, page *model.Page) (*model.PhotoPage, error) {
+	// Photos are compared by (date, uuid), which is served by date_uuid_index.
+	where := append(squirrel.And{}, matching...)
+	if page.After != nil {
+		where = append(where, squirrel.Expr("(date, uuid) < (?, ?)", storedDate(page.After.Date), page.After.UUID))
+	}
+	if page.Before != nil {
+		where = append(where, squirrel.Expr("(date, uuid) > (?, ?)", storedDate(page.Before.Date), page.Before.UUID))
+	}
+
+	// Paging backwards reads from the oldest end of the range.
+	backward := page.Last > 0
+	limit, orderBy := page.First, []string{"date DESC", "uuid DESC"}
+	if backward {
+		limit, orderBy = page.Last, []string{"date ASC", "uuid ASC"}
+	}
+
+	// Ask for one more than the limit to find out if there are more.
+	sql, args, err := squirrel.
+		Select("uuid", "name", "date", "orientation", "blurhash", "dominant_color", "aspect_ratio", "caption").
+		From("photos").
+		Where(where).
+		OrderBy(orderBy...).
+		Limit(uint64(limit + 1)).
+		ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for photos")
+		return nil, err
+	}
 
 	var photos []*model.Photo = make([]*model.Photo, 0)
-	err := d.db.Select(&photos, `
-		SELECT uuid, name, date, strftime("%Y-%m-%dT%H:%M:%S:%f", date) || "~" || name || "~" || uuid AS cursor
-		FROM photos
-		WHERE year = ? AND month = ? AND (? = '' OR cursor < ?)
-		ORDER BY cursor DESC
-		LIMIT ?
-	`, year, month, after, after, limit+1)
+	if err := d.db.Select(&photos, sql, args...); err != nil {
+		log.WithError(err).Error("failed to query photos")
+		return nil, err
+	}
+
+	hasMore := len(photos) > limit
+	if hasMore {
+		photos = photos[:limit]
+	}
+
+	result := &model.PhotoPage{Photos: photos}
+	if backward {
+		for i, j := 0, len(photos)-1; i < j; i, j = i+1, j-1 {
+			photos[i], photos[j] = photos[j], photos[i]
+		}
+		result.HasPreviousPage = hasMore
+		if page.Before != nil {
+			result.HasNextPage, err = d.anyPhotos(append(matching, squirrel.Expr("(date, uuid) <= (?, ?)", storedDate(page.Before.Date), page.Before.UUID)))
+		}
+	} else {
+		result.HasNextPage = hasMore
+		if page.After != nil {
+			result.HasPreviousPage, err = d.anyPhotos(append(matching, squirrel.Expr("(date, uuid) >= (?, ?)", storedDate(page.After.Date), page.After.UUID)))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// anyPhotos returns whether any photos match the condition.
+func (d *Database) anyPhotos(where squirrel.Sqlizer) (bool, error) {
+	sql, args, err := squirrel.Select("1").From("photos").Where(where).Limit(1).Prefix("SELECT EXISTS (").Suffix(")").ToSql()
 	if err != nil {
+		log.WithError(err).Error("failed to build query for photos")
+		return false, err
+	}
+
+	var exists bool
+	if err := d.db.Get(&exists, sql, args...); err != nil {
 		log.WithError(err).Error("failed to query photos")
+		return false, err
+	}
+	return exists, nil
+}
+
+// visibleSQL matches the photos a user may see: those not hidden from
+// everyone, nor by the user. Its placeholder is the user.
+const visibleSQL = `(NOT hidden AND NOT EXISTS (
+	SELECT 1 FROM photo_user_state
+	WHERE photo_user_state.user = ? AND photo_user_state.photo_uuid = photos.uuid AND photo_user_state.hidden
+))`
+
+// visibleTo is visibleSQL as a condition for squirrel queries.
+func visibleTo(user string) squirrel.Sqlizer {
+	return squirrel.Expr(visibleSQL, user)
+}
+
+// matching is the condition for the photos visible to the user that match the
+// filter. A nil filter matches every visible photo.
+func matching(user string, filter *model.PhotoFilter) squirrel.And {
+	where := squirrel.And{visibleTo(user)}
+	if filter == nil {
+		return where
+	}
+
+	if filter.Folder != "" {
+		prefix := strings.Trim(filter.Folder, "/") + "/"
+		// substr rather than LIKE so that _ and % in folder names are literal.
+		where = append(where, squirrel.Expr("substr(path, 1, ?) = ?", len(prefix), prefix))
+	}
+	// Dates are compared as the stored text, as in bucketRange.
+	if filter.From != "" {
+		where = append(where, squirrel.Expr("date >= ?", filter.From))
+	}
+	if filter.To != "" {
+		where = append(where, squirrel.Expr("date < ?", filter.To+"~"))
+	}
+
+	// Favorites and ratings are the user's own.
+	if filter.Favorites || filter.MinRating > 0 {
+		state := squirrel.
+			Select("1").
+			From("photo_user_state").
+			Where("photo_user_state.user = ? AND photo_user_state.photo_uuid = photos.uuid", user)
+		if filter.Favorites {
+			state = state.Where("photo_user_state.favorite")
+		}
+		if filter.MinRating > 0 {
+			state = state.Where("photo_user_state.rating >= ?", filter.MinRating)
+		}
+		where = append(where, state.Prefix("EXISTS (").Suffix(")"))
+	}
+
+	return where
+}
+
+// storedDate formats a time as the SQLite driver stores it, so that it
+// compares with the date column as the stored text does.
+func storedDate(date time.Time) string {
+	return date.Format(sqlite3.SQLiteTimestampFormats[0])
+}
+
+// Memories returns the photos visible to the user taken within windowDays of
+// the date's month and day in earlier years, newest first. Each photo is
+// counted from the anniversary of it in the window, so with a window crossing
+// New Year a photo from December 30th of the year before the date is not a
+// year old yet. At most limit photos are included for each year, oldest first.
+func (d *Database) Memories(user string, date time.Time, windowDays, limit int) ([]*model.Memory, error) {
+	// Days are counted in the year the window's day falls in. Outside of leap
+	// years, photos from February 29th are remembered on the 28th.
+	var values []string
+	var days []interface{}
+	for offset := -windowDays; offset <= windowDays; offset++ {
+		day := date.AddDate(0, 0, offset)
+		values = append(values, "(?, ?, ?)")
+		days = append(days, int(day.Month()), day.Day(), day.Year())
+		if day.Month() == time.February && day.Day() == 28 && day.AddDate(0, 0, 1).Month() == time.March {
+			values = append(values, "(?, ?, ?)")
+			days = append(days, int(time.February), 29, day.Year())
+		}
+	}
+
+	sql, args, err := squirrel.
+		Select("uuid", "name", "date", "photos.year", "orientation", "blurhash", "dominant_color", "aspect_ratio", "caption", "anniversaries.year - photos.year AS years_ago").
+		Prefix("WITH anniversaries (month, day, year) AS (VALUES "+strings.Join(values, ", ")+")", days...).
+		From("photos").
+		Join("anniversaries ON anniversaries.month = photos.month AND anniversaries.day = photos.day").
+		Where(visibleTo(user)).
+		Where("anniversaries.year > photos.year").
+		OrderBy("years_ago", "date", "uuid").
+		ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for memories")
+		return nil, err
+	}
+
+	var photos []*struct {
+		model.Photo
+		YearsAgo int `db:"years_ago"`
+	}
+	if err := d.db.Select(&photos, sql, args...); err != nil {
+		log.WithError(err).Error("failed to query memories")
+		return nil, err
+	}
+
+	memories := make([]*model.Memory, 0)
+	var memory *model.Memory
+	for _, photo := range photos {
+		if memory == nil || memory.YearsAgo != photo.YearsAgo {
+			memory = &model.Memory{Year: date.Year() - photo.YearsAgo, YearsAgo: photo.YearsAgo}
+			memories = append(memories, memory)
+		}
+		memory.TotalCount++
+		if len(memory.Photos) < limit {
+			photo := photo.Photo
+			memory.Photos = append(memory.Photos, &photo)
+		}
+	}
+
+	return memories, nil
+}
+
+// ShuffledPhotoUUIDs returns the UUIDs of up to limit photos visible to the
+// user matching the filter, in the seed's order, and whether there are more.
+// The page starts after the photo with the UUID after, or at the beginning if
+// it is empty. That photo may be gone by now, but its place in the order is not.
+func (d *Database) ShuffledPhotoUUIDs(user string, filter *model.PhotoFilter, seed int, after string, limit int) ([]string, bool, error) {
+	where := matching(user, filter)
+	if after != "" {
+		where = append(where, squirrel.Expr("(shuffle_key(?, uuid), uuid) > (shuffle_key(?, ?), ?)", seed, seed, after, after))
+	}
+
+	// Ask for one more than the limit to find out if there are more.
+	sql, args, err := squirrel.
+		Select("uuid").
+		From("photos").
+		Where(where).
+		OrderByClause("shuffle_key(?, uuid), uuid", seed).
+		Limit(uint64(limit + 1)).
+		ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for shuffled photos")
 		return nil, false, err
 	}
 
-	// When we query above we actually add 1 to the limit. If 1 more than our
-	// limit came back, there's more data.
-	hasMore := len(photos) > limit
+	var uuids []string = make([]string, 0)
+	if err := d.db.Select(&uuids, sql, args...); err != nil {
+		log.WithError(err).Error("failed to query shuffled photos")
+		return nil, false, err
+	}
+
+	hasMore := len(uuids) > limit
+	if hasMore {
+		uuids = uuids[:limit]
+	}
+	return uuids, hasMore, nil
+}
 
-	endIndex := limit
-	if !hasMore {
-		endIndex = len(photos)
+// CountPhotos returns how many photos visible to the user match the filter.
+func (d *Database) CountPhotos(user string, filter *model.PhotoFilter) (int, error) {
+	sql, args, err := squirrel.Select("COUNT(*)").From("photos").Where(matching(user, filter)).ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for photo count")
+		return 0, err
 	}
 
-	if len(photos) > 0 {
-		log.Debugf("[datasource.AllPhotos] photos slice from %d to %d", 0, endIndex)
-		photos = photos[0:endIndex]
+	var count int
+	if err := d.db.Get(&count, sql, args...); err != nil {
+		log.WithError(err).Error("failed to count photos")
+		return 0, err
 	}
+	return count, nil
+}
 
-	return photos, hasMore, nil
+// shuffleKey is where a photo goes in the seed's order. It is the shuffle_key
+// SQL function.
+func shuffleKey(seed int64, uuid string) int64 {
+	hash := fnv.New64a()
+	binary.Write(hash, binary.BigEndian, seed)
+	hash.Write([]byte(uuid))
+	return int64(hash.Sum64())
 }
 
 // AddPhoto inserts a record into the database with photo information.
 func (d *Database) AddPhoto(photo *model.Photo) error {
 	_, err := d.db.NamedExec(`
 		INSERT INTO photos
-			(uuid, path, name, date, year, month)
+			(uuid, path, name, date, year, month, day, orientation)
 		VALUES
-			(:uuid, :path, :name, :date, :year, :month)
+			(:uuid, :path, :name, :date, :year, :month, :day, :orientation)
 	`, photo)
 	if err != nil {
 		log.WithError(err).Errorf("failed to insert photo %q", photo.Path)
@@ -207,7 +798,10 @@ func (d *Database) AddPhoto(photo *model.Photo) error {
 // GetPhoto returns a specific photo for a given uuid.
 func (d *Database) GetPhoto(uuid string) (*model.Photo, error) {
 	var photo model.Photo
-	err := d.db.Get(&photo, "SELECT uuid, path, date FROM photos WHERE uuid=?", uuid)
+	err := d.db.Get(&photo, "SELECT uuid, path, name, date, orientation, blurhash, dominant_color, aspect_ratio, hidden, caption FROM photos WHERE uuid=?", uuid)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		log.WithError(err).Errorf("failed to scan photo for uuid %q", uuid)
 		return nil, err
@@ -215,9 +809,72 @@ func (d *Database) GetPhoto(uuid string) (*model.Photo, error) {
 	return &photo, nil
 }
 
+// SetPhotoPlaceholder stores what the UI needs to draw a placeholder for a
+// photo before its thumbnail loads.
+func (d *Database) SetPhotoPlaceholder(photo *model.Photo) error {
+	_, err := d.db.NamedExec(`
+		UPDATE photos
+		SET blurhash = :blurhash, dominant_color = :dominant_color, aspect_ratio = :aspect_ratio
+		WHERE uuid = :uuid
+	`, photo)
+	if err != nil {
+		log.WithError(err).Errorf("failed to update placeholder for photo %q", photo.UUID)
+		return err
+	}
+	return nil
+}
+
+// GetPhotos returns the photos for the given uuids, in the same order. A uuid
+// without a photo has a nil entry.
+func (d *Database) GetPhotos(uuids ...string) ([]*model.Photo, error) {
+	return d.photosByUUID(squirrel.Eq{"uuid": uuids}, uuids)
+}
+
+// VisiblePhotos is GetPhotos for the photos visible to the user. The others
+// are nil, as if they did not exist.
+func (d *Database) VisiblePhotos(user string, uuids ...string) ([]*model.Photo, error) {
+	return d.photosByUUID(squirrel.And{squirrel.Eq{"uuid": uuids}, visibleTo(user)}, uuids)
+}
+
+// photosByUUID returns the photos matching the condition in the order of the
+// uuids, with nil for those that do not match.
+func (d *Database) photosByUUID(where squirrel.Sqlizer, uuids []string) ([]*model.Photo, error) {
+	photos := make([]*model.Photo, len(uuids))
+	if len(uuids) == 0 {
+		return photos, nil
+	}
+
+	sql, args, err := squirrel.
+		Select("uuid", "path", "name", "date", "orientation", "blurhash", "dominant_color", "aspect_ratio", "hidden", "caption").
+		From("photos").
+		Where(where).
+		ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for photos")
+		return nil, err
+	}
+
+	var results []*model.Photo = make([]*model.Photo, 0)
+	err = d.db.Select(&results, sql, args...)
+	if err != nil {
+		log.WithError(err).Error("failed to query photos")
+		return nil, err
+	}
+
+	byUUID := make(map[string]*model.Photo, len(results))
+	for _, photo := range results {
+		byUUID[photo.UUID] = photo
+	}
+	for index, uuid := range uuids {
+		photos[index] = byUUID[uuid]
+	}
+
+	return photos, nil
+}
+
 func (d *Database) AllPaginated(limit, offset int) ([]*model.Photo, error) {
 	var photos []*model.Photo = make([]*model.Photo, 0)
-	err := d.db.Select(&photos, "SELECT path, uuid FROM photos ORDER BY path DESC LIMIT ? OFFSET ?", limit, offset)
+	err := d.db.Select(&photos, "SELECT path, uuid, orientation, blurhash, dominant_color, aspect_ratio FROM photos ORDER BY path DESC LIMIT ? OFFSET ?", limit, offset)
 	if err != nil {
 		log.WithError(err).Error("failed to load photos")
 		return nil, err
@@ -225,3 +882,432 @@ func (d *Database) AllPaginated(limit, offset int) ([]*model.Photo, error) {
 
 	return photos, err
 }
+
+// RecordThumbnail adds a generated thumbnail, or updates it if it was
+// regenerated.
+func (d *Database) RecordThumbnail(thumbnail *model.Thumbnail) error {
+	_, err := d.db.NamedExec(`
+		INSERT INTO thumbnails
+			(path, uuid, bytes, last_access)
+		VALUES
+			(:path, :uuid, :bytes, :last_access)
+		ON CONFLICT(path) DO UPDATE SET
+			bytes = excluded.bytes,
+			last_access = excluded.last_access
+	`, thumbnail)
+	if err != nil {
+		log.WithError(err).Errorf("failed to record thumbnail %q", thumbnail.Path)
+		return err
+	}
+	return nil
+}
+
+// ImportThumbnail adds a thumbnail that was generated before thumbnails were
+// tracked. A thumbnail that is already tracked is left alone.
+func (d *Database) ImportThumbnail(thumbnail *model.Thumbnail) error {
+	_, err := d.db.NamedExec(`
+		INSERT OR IGNORE INTO thumbnails
+			(path, uuid, bytes, last_access)
+		VALUES
+			(:path, :uuid, :bytes, :last_access)
+	`, thumbnail)
+	if err != nil {
+		log.WithError(err).Errorf("failed to import thumbnail %q", thumbnail.Path)
+		return err
+	}
+	return nil
+}
+
+// RemoveOrphanedThumbnails deletes the records of thumbnails for photos that
+// no longer exist.
+func (d *Database) RemoveOrphanedThumbnails() error {
+	_, err := d.db.Exec("DELETE FROM thumbnails WHERE uuid NOT IN (SELECT uuid FROM photos)")
+	if err != nil {
+		log.WithError(err).Error("failed to remove orphaned thumbnails")
+		return err
+	}
+	return nil
+}
+
+// TouchThumbnail updates when a thumbnail was last served.
+func (d *Database) TouchThumbnail(path string, lastAccess int64) error {
+	_, err := d.db.Exec("UPDATE thumbnails SET last_access = ? WHERE path = ?", lastAccess, path)
+	if err != nil {
+		log.WithError(err).Errorf("failed to touch thumbnail %q", path)
+		return err
+	}
+	return nil
+}
+
+// ThumbnailUsage returns the total size, in bytes, of all recorded thumbnails.
+func (d *Database) ThumbnailUsage() (int64, error) {
+	var usage int64
+	err := d.db.Get(&usage, "SELECT COALESCE(SUM(bytes), 0) FROM thumbnails")
+	if err != nil {
+		log.WithError(err).Error("failed to sum thumbnail usage")
+		return 0, err
+	}
+	return usage, nil
+}
+
+// LeastRecentlyUsedThumbnails returns the thumbnails that were served longest
+// ago, first.
+func (d *Database) LeastRecentlyUsedThumbnails(limit int) ([]*model.Thumbnail, error) {
+	var thumbnails []*model.Thumbnail = make([]*model.Thumbnail, 0)
+	err := d.db.Select(&thumbnails, "SELECT path, uuid, bytes, last_access FROM thumbnails ORDER BY last_access ASC LIMIT ?", limit)
+	if err != nil {
+		log.WithError(err).Error("failed to load least recently used thumbnails")
+		return nil, err
+	}
+	return thumbnails, nil
+}
+
+// RemoveThumbnail deletes the record of a thumbnail, unless it was accessed or
+// regenerated since it was loaded. It returns whether or not it was removed.
+func (d *Database) RemoveThumbnail(thumbnail *model.Thumbnail) (bool, error) {
+	result, err := d.db.Exec("DELETE FROM thumbnails WHERE path = ? AND last_access = ?", thumbnail.Path, thumbnail.LastAccess)
+	if err != nil {
+		log.WithError(err).Errorf("failed to remove thumbnail %q", thumbnail.Path)
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return removed > 0, nil
+}
+
+// SetPhotoHidden hides or unhides a photo.
+func (d *Database) SetPhotoHidden(uuid string, hidden bool) error {
+	return d.updatePhoto(uuid, "hidden", hidden)
+}
+
+// SetPhotoCaption sets the caption of a photo.
+func (d *Database) SetPhotoCaption(uuid, caption string) error {
+	return d.updatePhoto(uuid, "caption", caption)
+}
+
+// SetPhotoOrientation sets the EXIF orientation used to render a photo.
+func (d *Database) SetPhotoOrientation(uuid string, orientation int) error {
+	return d.updatePhoto(uuid, "orientation", orientation)
+}
+
+// updatePhoto sets a single column of a photo. The column must never come
+// from user input.
+func (d *Database) updatePhoto(uuid, column string, value interface{}) error {
+	sql, args, err := squirrel.Update("photos").Set(column, value).Where(squirrel.Eq{"uuid": uuid}).ToSql()
+	if err != nil {
+		return err
+	}
+	result, err := d.db.Exec(sql, args...)
+	if err != nil {
+		log.WithError(err).Errorf("failed to update %s of photo %q", column, uuid)
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PhotoUserStates returns what the user has marked each photo as, in the same
+// order as the uuids.
+func (d *Database) PhotoUserStates(user string, uuids ...string) ([]*model.PhotoUserState, error) {
+	states := make([]*model.PhotoUserState, len(uuids))
+	for index, uuid := range uuids {
+		states[index] = &model.PhotoUserState{PhotoUUID: uuid}
+	}
+	if len(uuids) == 0 {
+		return states, nil
+	}
+
+	sql, args, err := squirrel.
+		Select("photo_uuid", "favorite", "rating", "hidden").
+		From("photo_user_state").
+		Where(squirrel.Eq{"user": user, "photo_uuid": uuids}).
+		ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for photo user state")
+		return nil, err
+	}
+
+	var results []*model.PhotoUserState = make([]*model.PhotoUserState, 0)
+	if err := d.db.Select(&results, sql, args...); err != nil {
+		log.WithError(err).Error("failed to query photo user state")
+		return nil, err
+	}
+
+	byUUID := make(map[string]*model.PhotoUserState, len(results))
+	for _, result := range results {
+		byUUID[result.PhotoUUID] = result
+	}
+	for index, uuid := range uuids {
+		if state, ok := byUUID[uuid]; ok {
+			states[index] = state
+		}
+	}
+
+	return states, nil
+}
+
+// SetPhotoUserState stores what the user has marked a photo as.
+func (d *Database) SetPhotoUserState(user string, state *model.PhotoUserState) error {
+	_, err := d.db.Exec(`
+		INSERT INTO photo_user_state (user, photo_uuid, favorite, rating, hidden)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user, photo_uuid) DO UPDATE
+		SET favorite = excluded.favorite, rating = excluded.rating, hidden = excluded.hidden
+	`, user, state.PhotoUUID, state.Favorite, state.Rating, state.Hidden)
+	if err != nil {
+		log.WithError(err).Errorf("failed to update user state of photo %q", state.PhotoUUID)
+		return err
+	}
+	return nil
+}
+
+// normalizeTag returns what tags are compared by. Tags differing only in case
+// or surrounding spaces are the same tag.
+func normalizeTag(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Tags returns every tag on photos visible to the user, by name.
+func (d *Database) Tags(user string) ([]*model.Tag, error) {
+	var tags []*model.Tag = make([]*model.Tag, 0)
+	err := d.db.Select(&tags, `
+		SELECT tags.name, count(*) AS total_count
+		FROM tags
+		JOIN photo_tags ON photo_tags.tag_id = tags.id
+		JOIN photos ON photos.uuid = photo_tags.photo_uuid
+		WHERE `+visibleSQL+`
+		GROUP BY tags.id
+		ORDER BY tags.normalized
+	`, user)
+	if err != nil {
+		log.WithError(err).Error("failed to query tags")
+		return nil, err
+	}
+	return tags, nil
+}
+
+// Tag returns a tag, with the number of its photos visible to the user.
+func (d *Database) Tag(user, name string) (*model.Tag, error) {
+	var tag model.Tag
+	err := d.db.Get(&tag, `
+		SELECT tags.name, (
+			SELECT count(*)
+			FROM photo_tags
+			JOIN photos ON photos.uuid = photo_tags.photo_uuid
+			WHERE photo_tags.tag_id = tags.id AND `+visibleSQL+`
+		) AS total_count
+		FROM tags
+		WHERE tags.normalized = ?
+	`, user, normalizeTag(name))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		log.WithError(err).Errorf("failed to query tag %q", name)
+		return nil, err
+	}
+	return &tag, nil
+}
+
+// PhotoTags returns the names of the tags of each photo, by name, in the same
+// order as the uuids.
+func (d *Database) PhotoTags(uuids ...string) ([][]string, error) {
+	tags := make([][]string, len(uuids))
+	for index := range tags {
+		tags[index] = make([]string, 0)
+	}
+	if len(uuids) == 0 {
+		return tags, nil
+	}
+
+	sql, args, err := squirrel.
+		Select("photo_tags.photo_uuid", "tags.name").
+		From("photo_tags").
+		Join("tags ON tags.id = photo_tags.tag_id").
+		Where(squirrel.Eq{"photo_tags.photo_uuid": uuids}).
+		OrderBy("tags.normalized").
+		ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query for photo tags")
+		return nil, err
+	}
+
+	var results []struct {
+		PhotoUUID string `db:"photo_uuid"`
+		Name      string
+	}
+	if err := d.db.Select(&results, sql, args...); err != nil {
+		log.WithError(err).Error("failed to query photo tags")
+		return nil, err
+	}
+
+	byUUID := make(map[string][]string, len(results))
+	for _, result := range results {
+		byUUID[result.PhotoUUID] = append(byUUID[result.PhotoUUID], result.Name)
+	}
+	for index, uuid := range uuids {
+		if names, ok := byUUID[uuid]; ok {
+			tags[index] = names
+		}
+	}
+
+	return tags, nil
+}
+
+// AddTags tags every photo with every tag. Tags are created as needed, named
+// as they are first added.
+func (d *Database) AddTags(uuids, names []string) error {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		normalized := normalizeTag(name)
+		if _, err := tx.Exec("INSERT INTO tags (name, normalized) VALUES (?, ?) ON CONFLICT (normalized) DO NOTHING", name, normalized); err != nil {
+			log.WithError(err).Errorf("failed to create tag %q", name)
+			return err
+		}
+		for _, uuid := range uuids {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO photo_tags (photo_uuid, tag_id) SELECT ?, id FROM tags WHERE normalized = ?", uuid, normalized); err != nil {
+				log.WithError(err).Errorf("failed to tag photo %q with %q", uuid, name)
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RemoveTags removes every tag from every photo. Tags left without photos are
+// deleted.
+func (d *Database) RemoveTags(uuids, names []string) error {
+	normalized := make([]string, len(names))
+	for index, name := range names {
+		normalized[index] = normalizeTag(name)
+	}
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sql, args, err := squirrel.
+		Delete("photo_tags").
+		Where(squirrel.Eq{"photo_uuid": uuids}).
+		Where(squirrel.Expr("tag_id IN (SELECT id FROM tags WHERE normalized IN ("+squirrel.Placeholders(len(normalized))+"))", stringArgs(normalized)...)).
+		ToSql()
+	if err != nil {
+		log.WithError(err).Error("failed to build query to remove tags")
+		return err
+	}
+	if _, err := tx.Exec(sql, args...); err != nil {
+		log.WithError(err).Error("failed to remove tags")
+		return err
+	}
+	if err := deleteUnusedTags(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteUnusedTags deletes the tags no photo has.
+func deleteUnusedTags(db sqlx.Execer) error {
+	_, err := db.Exec("DELETE FROM tags WHERE NOT EXISTS (SELECT 1 FROM photo_tags WHERE photo_tags.tag_id = tags.id)")
+	if err != nil {
+		log.WithError(err).Error("failed to delete unused tags")
+	}
+	return err
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for index, value := range values {
+		args[index] = value
+	}
+	return args
+}
+
+// DeletePhoto removes a photo, with its user state, tags and the records of its
+// thumbnails, from the DB.
+func (d *Database) DeletePhoto(uuid string) error {
+	result, err := d.db.Exec("DELETE FROM photos WHERE uuid = ?", uuid)
+	if err != nil {
+		log.WithError(err).Errorf("failed to delete photo %q", uuid)
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	if _, err := d.db.Exec("DELETE FROM photo_user_state WHERE photo_uuid = ?", uuid); err != nil {
+		log.WithError(err).Errorf("failed to delete user state of photo %q", uuid)
+		return err
+	}
+	if _, err := d.db.Exec("DELETE FROM photo_tags WHERE photo_uuid = ?", uuid); err != nil {
+		log.WithError(err).Errorf("failed to delete tags of photo %q", uuid)
+		return err
+	}
+	if err := deleteUnusedTags(d.db); err != nil {
+		return err
+	}
+	return d.RemoveThumbnailsForPhoto(uuid)
+}
+
+// RemoveThumbnailsForPhoto deletes the records of every thumbnail of a photo.
+func (d *Database) RemoveThumbnailsForPhoto(uuid string) error {
+	_, err := d.db.Exec("DELETE FROM thumbnails WHERE uuid = ?", uuid)
+	if err != nil {
+		log.WithError(err).Errorf("failed to remove thumbnails of photo %q", uuid)
+		return err
+	}
+	return nil
+}
+
+// HasPhotoPath returns whether or not a photo with the relative path is
+// already indexed.
+func (d *Database) HasPhotoPath(path string) (bool, error) {
+	var count int
+	err := d.db.Get(&count, "SELECT COUNT(*) FROM photos WHERE path = ?", path)
+	if err != nil {
+		log.WithError(err).Errorf("failed to look up photo %q", path)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// PhotosInDirectory returns every photo under the relative directory, at any
+// depth. An empty directory is the root, so every photo is returned.
+func (d *Database) PhotosInDirectory(directory string) ([]*model.Photo, error) {
+	prefix := ""
+	if directory != "" {
+		prefix = strings.TrimSuffix(directory, "/") + "/"
+	}
+
+	var photos []*model.Photo = make([]*model.Photo, 0)
+	// substr rather than LIKE so that _ and % in directory names are literal.
+	err := d.db.Select(&photos, "SELECT uuid, path FROM photos WHERE substr(path, 1, ?) = ?", len(prefix), prefix)
+	if err != nil {
+		log.WithError(err).Errorf("failed to load photos in %q", directory)
+		return nil, err
+	}
+	return photos, nil
+}
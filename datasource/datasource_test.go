@@ -0,0 +1,229 @@
+package datasource
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/williamhaley/photo-server/model"
+)
+
+// newTestDatabase returns an empty database with the given photos, by date.
+func newTestDatabase(t *testing.T, dates ...string) *Database {
+	t.Helper()
+
+	db := New(t.TempDir())
+	t.Cleanup(func() { db.Close() })
+
+	for _, value := range dates {
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.AddPhoto(model.NewPhoto(&date, value+".jpg", 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestMemories(t *testing.T) {
+	db := newTestDatabase(t, "2023-12-29", "2022-12-30", "2023-01-01", "2021-01-05", "2024-01-03", "2020-02-29")
+
+	tests := []struct {
+		name       string
+		date       string
+		windowDays int
+		// The photos of each memory, newest year first.
+		want map[int][]string
+	}{
+		{"across new year", "2024-01-02", 5, map[int][]string{
+			1: {"2022-12-30.jpg", "2023-01-01.jpg"},
+			3: {"2021-01-05.jpg"},
+		}},
+		{"same day only", "2025-01-03", 0, map[int][]string{
+			1: {"2024-01-03.jpg"},
+		}},
+		{"window before new year", "2024-12-31", 2, map[int][]string{
+			1: {"2023-12-29.jpg"},
+			2: {"2022-12-30.jpg", "2023-01-01.jpg"},
+		}},
+		{"leap day outside of leap years", "2021-02-28", 0, map[int][]string{
+			1: {"2020-02-29.jpg"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			date, _ := time.Parse("2006-01-02", test.date)
+			memories, err := db.Memories("", date, test.windowDays, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(memories) != len(test.want) {
+				t.Fatalf("got %d memories, want %d", len(memories), len(test.want))
+			}
+			previous := 0
+			for _, memory := range memories {
+				if memory.YearsAgo <= previous {
+					t.Errorf("memory %d years ago is out of order", memory.YearsAgo)
+				}
+				previous = memory.YearsAgo
+				if memory.Year != date.Year()-memory.YearsAgo {
+					t.Errorf("memory %d years ago has year %d", memory.YearsAgo, memory.Year)
+				}
+
+				want := test.want[memory.YearsAgo]
+				if memory.TotalCount != len(want) || len(memory.Photos) != len(want) {
+					t.Fatalf("memory %d years ago has %d photos, want %v", memory.YearsAgo, memory.TotalCount, want)
+				}
+				for index, photo := range memory.Photos {
+					if photo.Name != want[index] {
+						t.Errorf("memory %d years ago photo %d is %q, want %q", memory.YearsAgo, index, photo.Name, want[index])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestShuffledPhotoUUIDs(t *testing.T) {
+	db := newTestDatabase(t, "2020-01-01", "2020-01-02", "2020-01-03", "2020-01-04", "2020-01-05", "2020-01-06", "2020-01-07")
+
+	all, hasMore, err := db.ShuffledPhotoUUIDs("", nil, 42, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 7 || hasMore {
+		t.Fatalf("got %d photos and more %v, want 7 and no more", len(all), hasMore)
+	}
+	if count, err := db.CountPhotos("", nil); err != nil || count != 7 {
+		t.Fatalf("got count %d (%v), want 7", count, err)
+	}
+
+	// Pages of 3 follow the same order.
+	var paged []string
+	after := ""
+	for {
+		uuids, hasMore, err := db.ShuffledPhotoUUIDs("", nil, 42, after, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paged = append(paged, uuids...)
+		if !hasMore {
+			break
+		}
+		after = uuids[len(uuids)-1]
+	}
+	if strings.Join(paged, ",") != strings.Join(all, ",") {
+		t.Errorf("pages are in the order %v, want %v", paged, all)
+	}
+
+	// Another seed is another order.
+	other, _, err := db.ShuffledPhotoUUIDs("", nil, 43, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(other, ",") == strings.Join(all, ",") {
+		t.Errorf("seeds 42 and 43 have the same order %v", all)
+	}
+
+	// The page after a deleted photo starts where it was.
+	if err := db.DeletePhoto(all[2]); err != nil {
+		t.Fatal(err)
+	}
+	uuids, _, err := db.ShuffledPhotoUUIDs("", nil, 42, all[2], 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(uuids, ",") != strings.Join(all[3:], ",") {
+		t.Errorf("after a deleted photo got %v, want %v", uuids, all[3:])
+	}
+}
+
+func TestBucketRange(t *testing.T) {
+	tests := []struct {
+		id          string
+		granularity model.Granularity
+		from, to    string
+		// Dates stored inside and outside of the range.
+		in, out []string
+	}{
+		{"2020", model.GranularityYear, "2020-", "2020~", []string{"2020-01-01 00:00:00", "2020-12-31 23:59:59"}, []string{"2019-12-31 23:59:59", "2021-01-01 00:00:00"}},
+		{"2020-02", model.GranularityMonth, "2020-02", "2020-02~", []string{"2020-02-01 00:00:00", "2020-02-29 23:59:59"}, []string{"2020-01-31 23:59:59", "2020-03-01 00:00:00"}},
+		{"2020-02-29", model.GranularityDay, "2020-02-29", "2020-02-29~", []string{"2020-02-29 00:00:00", "2020-02-29 23:59:59+01:00"}, []string{"2020-02-28 23:59:59", "2020-03-01 00:00:00"}},
+		{
+			"2020-06-01T10:00:00/2020-06-01T12:30:00", model.GranularityEvent, "2020-06-01 10:00:00", "2020-06-01 12:30:00~",
+			[]string{"2020-06-01 10:00:00", "2020-06-01 12:30:00", "2020-06-01 12:30:00.5+02:00"},
+			[]string{"2020-06-01 09:59:59", "2020-06-01 12:30:01"},
+		},
+		{"2020-06-01T10:00:00/2020-06-01T10:00:00", model.GranularityEvent, "2020-06-01 10:00:00", "2020-06-01 10:00:00~", []string{"2020-06-01 10:00:00"}, []string{"2020-06-01 10:00:01"}},
+	}
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			granularity, from, to, err := bucketRange(test.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if granularity != test.granularity || from != test.from || to != test.to {
+				t.Errorf("got %s [%q, %q), want %s [%q, %q)", granularity, from, to, test.granularity, test.from, test.to)
+			}
+			for _, date := range test.in {
+				if date < from || date >= to {
+					t.Errorf("%q is not in the range", date)
+				}
+			}
+			for _, date := range test.out {
+				if date >= from && date < to {
+					t.Errorf("%q is in the range", date)
+				}
+			}
+		})
+	}
+
+	for _, id := range []string{"", "20", "2020-13", "2020-02-30", "2020/06", "20200601", "2020-06-01T12:00:00", "2020-06-01T12:00:00/2020-06-01T10:00:00", "2020-06-01T10:00:00/2020-06-01T12:00:00/2020-06-01T13:00:00", "2020-06-01/2020-06-02"} {
+		if _, _, _, err := bucketRange(id); err != ErrInvalidBucket {
+			t.Errorf("bucket %q got error %v, want %v", id, err, ErrInvalidBucket)
+		}
+	}
+}
+
+func TestHiddenPhotos(t *testing.T) {
+	db := newTestDatabase(t, "2020-01-01", "2020-01-02", "2020-01-03")
+	// By path, newest first.
+	photos, err := db.AllPaginated(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuids := []string{photos[2].UUID, photos[1].UUID, photos[0].UUID}
+
+	if err := db.SetPhotoHidden(uuids[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetPhotoUserState("alice", &model.PhotoUserState{PhotoUUID: uuids[1], Hidden: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for user, want := range map[string][]bool{"alice": {false, false, true}, "bob": {false, true, true}} {
+		visible, err := db.VisiblePhotos(user, uuids...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for index, photo := range visible {
+			if (photo != nil) != want[index] {
+				t.Errorf("photo %d visible to %s is %v, want visible %v", index, user, photo, want[index])
+			}
+		}
+	}
+
+	page, err := db.HiddenPhotos(&model.Page{First: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Photos) != 1 || page.Photos[0].UUID != uuids[0] || page.HasNextPage {
+		t.Errorf("got hidden photos %v, want only %q", page.Photos, uuids[0])
+	}
+	if count, err := db.HiddenPhotosCount(); err != nil || count != 1 {
+		t.Errorf("got %d hidden photos (%v), want 1", count, err)
+	}
+}
@@ -0,0 +1,166 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/williamhaley/photo-server/model"
+)
+
+// Event types.
+const (
+	ScanStarted       = "scan.started"
+	ScanProgress      = "scan.progress"
+	ScanFinished      = "scan.finished"
+	PhotoAdded        = "photo.added"
+	PhotoUpdated      = "photo.updated"
+	PhotoRemoved      = "photo.removed"
+	ThumbnailsEvicted = "thumbnails.evicted"
+)
+
+// historySize is how many recent events are kept so a subscriber that
+// reconnects can catch up on what it missed.
+const historySize = 256
+
+// Event is something that happened on the server. IDs increase by one with
+// every event.
+type Event struct {
+	ID   uint64
+	Type string
+	Data interface{}
+}
+
+// Scan is the data of the scan events. Found grows as the directory is walked,
+// so it is only the total once the scan finishes.
+type Scan struct {
+	Directory string  `json:"directory"`
+	Found     int     `json:"found"`
+	Processed int     `json:"processed"`
+	Seconds   float64 `json:"seconds,omitempty"`
+}
+
+// Photo is the data of the photo events. Its fields match the GraphQL photo
+// type. Only the UUID is set when a photo is removed.
+type Photo struct {
+	UUID          string  `json:"uuid"`
+	Path          string  `json:"path,omitempty"`
+	Name          string  `json:"name,omitempty"`
+	Date          string  `json:"date,omitempty"`
+	Year          int     `json:"year,omitempty"`
+	Month         int     `json:"month,omitempty"`
+	Orientation   int     `json:"orientation,omitempty"`
+	Hidden        bool    `json:"hidden,omitempty"`
+	Caption       string  `json:"caption,omitempty"`
+	BlurHash      string  `json:"blurHash,omitempty"`
+	DominantColor string  `json:"dominantColor,omitempty"`
+	AspectRatio   float64 `json:"aspectRatio,omitempty"`
+}
+
+// NewPhoto returns the data of an event about the photo.
+func NewPhoto(photo *model.Photo) Photo {
+	return Photo{
+		UUID:          photo.UUID,
+		Path:          photo.Path,
+		Name:          photo.Name,
+		Date:          photo.Date.Format(time.RFC3339),
+		Year:          photo.Date.Year(),
+		Month:         int(photo.Date.Month()),
+		Orientation:   photo.Orientation,
+		Hidden:        photo.Hidden,
+		Caption:       photo.Caption,
+		BlurHash:      photo.BlurHash,
+		DominantColor: photo.DominantColor,
+		AspectRatio:   photo.AspectRatio,
+	}
+}
+
+// Thumbnails is the data of the thumbnail events. UsageBytes is the size of
+// the cache after an eviction.
+type Thumbnails struct {
+	Evicted    int   `json:"evicted"`
+	UsageBytes int64 `json:"usageBytes"`
+}
+
+// Bus delivers events to every subscriber. A nil *Bus is valid and drops
+// every event, for commands that have no subscribers.
+type Bus struct {
+	mutex       sync.Mutex
+	lastID      uint64
+	history     []Event
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives events on C until it is closed. C is closed if the
+// subscriber falls too far behind, in which case it should subscribe again
+// from the last event it received.
+type Subscription struct {
+	C   <-chan Event
+	c   chan Event
+	bus *Bus
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Publish sends an event to every subscriber without waiting for them.
+func (b *Bus) Publish(eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastID++
+	event := Event{ID: b.lastID, Type: eventType, Data: data}
+
+	if len(b.history) == historySize {
+		b.history = append(b.history[:0], b.history[1:]...)
+	}
+	b.history = append(b.history, event)
+
+	for subscription := range b.subscribers {
+		select {
+		case subscription.c <- event:
+		default:
+			// Never block publishers on a slow subscriber.
+			delete(b.subscribers, subscription)
+			close(subscription.c)
+		}
+	}
+}
+
+// Subscribe returns a subscription to events after lastID, which is 0 for only
+// new events. Missed events that are still in the history are sent first.
+func (b *Bus) Subscribe(lastID uint64) *Subscription {
+	c := make(chan Event, historySize)
+	subscription := &Subscription{C: c, c: c, bus: b}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if lastID > 0 {
+		for _, event := range b.history {
+			if event.ID > lastID {
+				c <- event
+			}
+		}
+	}
+	b.subscribers[subscription] = struct{}{}
+
+	return subscription
+}
+
+// Close stops the subscription.
+func (s *Subscription) Close() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	if _, ok := s.bus.subscribers[s]; ok {
+		delete(s.bus.subscribers, s)
+		close(s.c)
+	}
+}
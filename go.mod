@@ -4,7 +4,10 @@ go 1.16
 
 require (
 	github.com/Masterminds/squirrel v1.4.0
+	github.com/buckket/go-blurhash v1.1.0
+	github.com/chai2010/webp v1.1.1
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/disintegration/gift v1.1.2
 	github.com/disintegration/imageorient v0.0.0-20180920195336-8147d86e83ec
 	github.com/dsoprea/go-exif/v3 v3.0.0-20200826225625-de2141190595
 	github.com/go-chi/chi v4.1.2+incompatible
@@ -24,6 +27,7 @@ require (
 	github.com/sirupsen/logrus v1.7.0
 	github.com/williamhaley/goepeg v0.0.0-20201207035158-2b7cce8e5e4f
 	github.com/williamhaley/gothumb v0.0.0-20201121035830-9a6db7556e69
-	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8
+	golang.org/x/image v0.0.0-20211028202545-6944b10bf410
 	google.golang.org/appengine v1.6.7 // indirect
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -1,44 +1,193 @@
 package indexer
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/williamhaley/photo-server/analyzer"
 	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/events"
 	"github.com/williamhaley/photo-server/model"
 	"github.com/williamhaley/photo-server/thumbnail"
 )
 
+// TrashDirectoryName is the directory, within the photos directory, that
+// deleted photos are moved to. It is never indexed.
+const TrashDirectoryName = ".trash"
+
+// ErrScanInProgress is returned when a scan is requested while another is
+// still running.
+var ErrScanInProgress = errors.New("a scan is already in progress")
+
+// progressInterval is how often scan progress events are published.
+const progressInterval = 500 * time.Millisecond
+
 type Indexer struct {
+	ctx                     context.Context
 	db                      *datasource.Database
 	photosDirectoryRootPath string
 	thumbnailManager        *thumbnail.Manager
+	events                  *events.Bus
 	batchSize               int
 	numWorkers              int
+	scanning                int32
+	scans                   sync.WaitGroup
 }
 
-func New(db *datasource.Database, photosDirectoryRootPath string, thumbnailManager *thumbnail.Manager, numWorkers int) *Indexer {
+// New returns an indexer. Scans stop looking for photos once ctx is done. Scan
+// progress and added or removed photos are published to the event bus, which
+// may be nil.
+func New(ctx context.Context, db *datasource.Database, photosDirectoryRootPath string, thumbnailManager *thumbnail.Manager, eventBus *events.Bus, numWorkers int) *Indexer {
 	return &Indexer{
+		ctx:                     ctx,
 		db:                      db,
 		photosDirectoryRootPath: photosDirectoryRootPath,
 		thumbnailManager:        thumbnailManager,
+		events:                  eventBus,
 		batchSize:               1000,
 		numWorkers:              numWorkers,
 	}
 }
 
+// Scan indexes every photo in the photos directory that is not indexed yet.
 func (i *Indexer) Scan() {
+	i.scan(i.photosDirectoryRootPath)
+}
+
+// StartScanDirectory indexes new photos in a directory, relative to the
+// photos directory, and forgets photos in it that no longer exist. The scan
+// runs in the background. Only one may run at a time. Wait for it with Wait.
+func (i *Indexer) StartScanDirectory(relativePath string) error {
+	directoryPath := filepath.Join(i.photosDirectoryRootPath, filepath.Clean("/"+relativePath))
+	info, err := os.Stat(directoryPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%q does not exist", relativePath)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", relativePath)
+	}
+	relativeDirectory, err := filepath.Rel(i.photosDirectoryRootPath, directoryPath)
+	if err != nil {
+		return err
+	}
+	if relativeDirectory == "." {
+		relativeDirectory = ""
+	}
+
+	if !atomic.CompareAndSwapInt32(&i.scanning, 0, 1) {
+		return ErrScanInProgress
+	}
+
+	i.scans.Add(1)
+	go func() {
+		defer i.scans.Done()
+		defer atomic.StoreInt32(&i.scanning, 0)
+
+		log.Infof("scanning %q", directoryPath)
+		if err := i.prune(relativeDirectory); err != nil {
+			log.WithError(err).Errorf("error forgetting removed photos in %q", directoryPath)
+			return
+		}
+		i.scan(directoryPath)
+	}()
+
+	return nil
+}
+
+// Wait blocks until the scan started by StartScanDirectory, if any, is done.
+func (i *Indexer) Wait() {
+	i.scans.Wait()
+}
+
+// prune forgets photos in the relative directory whose files were removed.
+func (i *Indexer) prune(relativeDirectory string) error {
+	photos, err := i.db.PhotosInDirectory(relativeDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, photo := range photos {
+		if err := i.ctx.Err(); err != nil {
+			return err
+		}
+		photoPath := filepath.Join(i.photosDirectoryRootPath, photo.Path)
+		if _, err := os.Stat(photoPath); !os.IsNotExist(err) {
+			continue
+		}
+		log.Infof("forgetting removed photo %q", photo.Path)
+		if err := i.db.DeletePhoto(photo.UUID); err != nil {
+			return err
+		}
+		i.events.Publish(events.PhotoRemoved, events.Photo{UUID: photo.UUID})
+		if i.thumbnailManager != nil {
+			if err := i.thumbnailManager.Invalidate(photo); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Trash moves a photo into the trash directory, keeping its relative path, and
+// removes it and its thumbnails from the index. A photo whose file is already
+// gone is still removed from the index.
+func (i *Indexer) Trash(photo *model.Photo) error {
+	sourcePath := filepath.Join(i.photosDirectoryRootPath, photo.Path)
+	trashPath := filepath.Join(i.photosDirectoryRootPath, TrashDirectoryName, photo.Path)
+
+	if _, err := os.Stat(sourcePath); err == nil {
+		if err := os.MkdirAll(filepath.Dir(trashPath), 0755); err != nil {
+			return err
+		}
+		// Keep a photo that was trashed earlier from the same path.
+		if _, err := os.Stat(trashPath); err == nil {
+			trashPath = fmt.Sprintf("%s.%d", trashPath, time.Now().Unix())
+		}
+		if err := os.Rename(sourcePath, trashPath); err != nil {
+			return err
+		}
+		log.Infof("moved %q to %q", sourcePath, trashPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := i.db.DeletePhoto(photo.UUID); err != nil {
+		return err
+	}
+	i.events.Publish(events.PhotoRemoved, events.Photo{UUID: photo.UUID})
+	if i.thumbnailManager != nil {
+		return i.thumbnailManager.Invalidate(photo)
+	}
+	return nil
+}
+
+func (i *Indexer) scan(directoryPath string) {
+	// Published paths are relative so they do not reveal the server's layout.
+	relativeDirectory, err := filepath.Rel(i.photosDirectoryRootPath, directoryPath)
+	if err != nil || relativeDirectory == "." {
+		relativeDirectory = ""
+	}
+	i.events.Publish(events.ScanStarted, events.Scan{Directory: relativeDirectory})
+
 	// https://blog.golang.org/pipelines
-	analysisInfoChan := i.fileProcessor()
+	var found int64
+	analysisInfoChan := i.fileProcessor(directoryPath, &found)
 	thumbnailChan := i.analysisInfoProcessor(analysisInfoChan)
 	progressChan := i.thumbnailProcessor(thumbnailChan)
 
 	start := time.Now()
 	batchStart := time.Now()
+	progressPublished := time.Now()
 
 	var total int
 	// Not running this in a gorouting. We want to actually block and wait for
@@ -50,38 +199,80 @@ func (i *Indexer) Scan() {
 			log.Infof("[completed] %d (%f/s)", progress, rate)
 			batchStart = time.Now()
 		}
+		if time.Since(progressPublished) >= progressInterval {
+			i.events.Publish(events.ScanProgress, events.Scan{
+				Directory: relativeDirectory,
+				Found:     int(atomic.LoadInt64(&found)),
+				Processed: progress,
+			})
+			progressPublished = time.Now()
+		}
 		total = progress
 	}
 	log.Infof("[done] scanned %d photos in %v seconds", total, time.Now().Sub(start))
+	i.events.Publish(events.ScanFinished, events.Scan{
+		Directory: relativeDirectory,
+		Found:     int(atomic.LoadInt64(&found)),
+		Processed: total,
+		Seconds:   time.Since(start).Seconds(),
+	})
 
 	log.Info("done")
 }
 
-func (i *Indexer) fileProcessor() <-chan *analyzer.AnalysisInfo {
+// fileProcessor counts the photos it finds to index in found.
+func (i *Indexer) fileProcessor(directoryPath string, found *int64) <-chan *analyzer.AnalysisInfo {
 	out := make(chan *analyzer.AnalysisInfo)
 
 	go func() {
-		err := filepath.Walk(i.photosDirectoryRootPath, func(photoPath string, info os.FileInfo, err error) error {
-			if err != nil {
-				log.WithError(err).Fatal("unexpected error")
+		defer close(out)
+
+		err := filepath.Walk(directoryPath, func(photoPath string, info os.FileInfo, err error) error {
+			// Photos found so far are still indexed.
+			if err := i.ctx.Err(); err != nil {
 				return err
 			}
+			// Skip what cannot be read rather than giving up on the scan.
+			if err != nil {
+				log.WithError(err).Errorf("error reading %q", photoPath)
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 			if info.IsDir() {
+				if info.Name() == TrashDirectoryName {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 
 			switch filepath.Ext(photoPath) {
 			case ".jpg", ".JPG", ".JPEG", ".jpeg":
+				// Skip photos that are already indexed so scans may be re-run.
+				relativePath, err := filepath.Rel(i.photosDirectoryRootPath, photoPath)
+				if err != nil {
+					log.WithError(err).Errorf("failed to resolve photo relative path %q %q", photoPath, i.photosDirectoryRootPath)
+					return nil
+				}
+				indexed, err := i.db.HasPhotoPath(relativePath)
+				if err != nil {
+					log.WithError(err).Errorf("failed to look up photo %q", relativePath)
+					return nil
+				}
+				if indexed {
+					return nil
+				}
+				atomic.AddInt64(found, 1)
 				analyzer.Analyze(os.ExpandEnv(photoPath), out)
 			}
 			return nil
 		})
-		if err != nil && err.Error() != "EOF" {
-			log.WithError(err).Fatalf("error walking directory")
-			return
+		if errors.Is(err, context.Canceled) {
+			log.Infof("stopped scanning %q", directoryPath)
+		} else if err != nil && err.Error() != "EOF" {
+			log.WithError(err).Errorf("error walking directory %q", directoryPath)
 		}
-
-		close(out)
 	}()
 
 	return out
@@ -95,10 +286,12 @@ func (i *Indexer) analysisInfoProcessor(in <-chan *analyzer.AnalysisInfo) <-chan
 	for j := 0; j < i.numWorkers; j++ {
 		waitGroup.Add(1)
 		go func() {
+			defer waitGroup.Done()
+
 			for analysisInfo := range in {
 				if analysisInfo.Error != nil {
-					log.WithError(analysisInfo.Error).Error("error!")
-					return
+					log.WithError(analysisInfo.Error).Errorf("failed to analyze photo %q", analysisInfo.Path)
+					continue
 				}
 
 				date := analysisInfo.Date
@@ -106,13 +299,20 @@ func (i *Indexer) analysisInfoProcessor(in <-chan *analyzer.AnalysisInfo) <-chan
 				// to re-home their server at any point.
 				relativePath, err := filepath.Rel(i.photosDirectoryRootPath, analysisInfo.Path)
 				if err != nil {
-					log.WithError(err).Fatalf("failed to resolve photo relative path %q %q", analysisInfo.Path, i.photosDirectoryRootPath)
+					log.WithError(err).Errorf("failed to resolve photo relative path %q %q", analysisInfo.Path, i.photosDirectoryRootPath)
+					continue
 				}
 
-				photo := model.NewPhoto(date, relativePath)
+				photo := model.NewPhoto(date, relativePath, analysisInfo.Orientation)
 				err = i.db.AddPhoto(photo)
 				if err != nil {
-					log.WithError(err).Fatalf("failed to index photo %q", photo.Path)
+					log.WithError(err).Errorf("failed to index photo %q", photo.Path)
+					continue
+				}
+				if len(analysisInfo.Keywords) > 0 {
+					if err := i.db.AddTags([]string{photo.UUID}, analysisInfo.Keywords); err != nil {
+						log.WithError(err).Errorf("failed to import keywords of photo %q", photo.Path)
+					}
 				}
 				total++
 				if total%i.batchSize == 0 {
@@ -122,7 +322,6 @@ func (i *Indexer) analysisInfoProcessor(in <-chan *analyzer.AnalysisInfo) <-chan
 					out <- photo
 				}
 			}
-			waitGroup.Done()
 		}()
 	}
 
@@ -146,24 +345,28 @@ func (i *Indexer) thumbnailProcessor(in <-chan *model.Photo) <-chan int {
 	for j := 0; j < i.numWorkers; j++ {
 		waitGroup.Add(1)
 		go func() {
+			defer waitGroup.Done()
+
 			for photo := range in {
-				file, created, err := i.thumbnailManager.Generate(photo, overwrite)
+				// The photo is indexed either way. Missing thumbnails are
+				// generated when they are first requested.
+				created, err := i.thumbnailManager.GenerateSizes(photo, overwrite)
 				if err != nil {
-					log.WithError(err).Fatalf("failed to generate thumbnail during indexing %q", photo.Path)
+					log.WithError(err).Errorf("failed to generate thumbnail during indexing %q", photo.Path)
 				}
-				if created {
+				if created > 0 {
 					thumbnailsCreated++
 				} else {
 					thumbnailsSkipped++
 				}
+				// Published once thumbnails exist, so they can be shown right away.
+				i.events.Publish(events.PhotoAdded, events.NewPhoto(photo))
 				total := thumbnailsCreated + thumbnailsSkipped
 				if total%i.batchSize == 0 {
 					log.Infof("[thumbnails] %d processed", total)
 				}
-				file.Close()
 				out <- total
 			}
-			waitGroup.Done()
 		}()
 	}
 
@@ -1,28 +1,27 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"flag"
 	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/config"
 	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/events"
 	"github.com/williamhaley/photo-server/indexer"
 	"github.com/williamhaley/photo-server/server"
 	"github.com/williamhaley/photo-server/thumbnail"
 )
 
-var errorInvalidThumbnailDirectory = fmt.Errorf("-thumbnails-directory must reference a valid directory")
-var errorInvalidPhotosDirectory = fmt.Errorf("-photos-directory must reference a valid directory")
-var errorInvalidDataDirectory = fmt.Errorf("-data-directory must reference a valid directory")
-var errorInvalidCertFilePath = fmt.Errorf("-https-cert-file path must be defined when using HTTPS")
-var errorInvalidCertKeyPath = fmt.Errorf("-https-cert-key path must be defined when using HTTPS")
-
 //go:embed ui/static
 var embeddedStaticContent embed.FS
 
@@ -45,50 +44,60 @@ func main() {
 
 	switch os.Args[1] {
 	case "index":
-		indexCommand := flag.NewFlagSet("index", flag.ExitOnError)
-		photosDirectoryRootPath := indexCommand.String("photos-directory", "", "Directory to search for indexing photos")
-		generateThumbnails := indexCommand.Bool("thumbnails", true, "Whether or not to generate thumbnails while indexing")
-		thumbnailsDirectoryPath := indexCommand.String("thumbnails-directory", "", "Directory to use for thumbnail")
-		dataDirectory := indexCommand.String("data-directory", "", "Directory to store application data")
-		numWorkers := indexCommand.Int("workers", 1, "Number of workers for index processing")
-
-		indexCommand.Parse(os.Args[2:])
+		cfg := config.Default()
+		indexCommand := cfg.NewFlagSet("index", "photos-directory", "thumbnails", "thumbnails-directory", "thumbnail-sizes", "thumbnail-formats", "thumbnail-quality", "thumbnail-backend", "thumbnail-cache-size", "data-directory", "workers")
 
-		err := index(os.ExpandEnv(*dataDirectory), os.ExpandEnv(*photosDirectoryRootPath), *generateThumbnails, os.ExpandEnv(*thumbnailsDirectoryPath), *numWorkers)
+		err := load(cfg, indexCommand, "index", os.Args[2:])
+		if err == nil {
+			err = index(cfg)
+		}
 		if err != nil {
 			fmt.Println(err)
 			fmt.Println()
 			indexCommand.PrintDefaults()
+			os.Exit(1)
 		}
 	case "thumbnails":
-		thumbnailsCommand := flag.NewFlagSet("thumbnails", flag.ExitOnError)
-		photosDirectoryRootPath := thumbnailsCommand.String("photos-directory", "", "Root directory for all photos")
-		thumbnailsDirectoryPath := thumbnailsCommand.String("thumbnails-directory", "", "Directory to use for thumbnail")
-		overwriteExisting := thumbnailsCommand.Bool("overwrite-existing", false, "Whether or not to clobber existing thumbnails")
-		dataDirectory := thumbnailsCommand.String("data-directory", "", "Directory to store application data")
-		numWorkers := thumbnailsCommand.Int("workers", 1, "Number of workers for generating thumbnails")
+		if len(os.Args) > 2 && os.Args[2] == "verify" {
+			cfg := config.Default()
+			verifyCommand := cfg.NewFlagSet("thumbnails verify", "photos-directory", "thumbnails-directory", "thumbnail-sizes", "thumbnail-formats", "thumbnail-quality", "thumbnail-backend", "thumbnail-cache-size", "display-size", "data-directory", "workers")
 
-		thumbnailsCommand.Parse(os.Args[2:])
+			err := load(cfg, verifyCommand, "thumbnails", os.Args[3:])
+			if err == nil {
+				err = verifyThumbnails(cfg)
+			}
+			if err != nil {
+				fmt.Println(err)
+				fmt.Println()
+				verifyCommand.PrintDefaults()
+				os.Exit(1)
+			}
+			break
+		}
+
+		cfg := config.Default()
+		thumbnailsCommand := cfg.NewFlagSet("thumbnails", "photos-directory", "thumbnails-directory", "thumbnail-sizes", "thumbnail-formats", "thumbnail-quality", "thumbnail-backend", "thumbnail-cache-size", "overwrite-existing", "data-directory", "workers")
 
-		err := thumbnails(os.ExpandEnv(*dataDirectory), os.ExpandEnv(*photosDirectoryRootPath), os.ExpandEnv(*thumbnailsDirectoryPath), *overwriteExisting, *numWorkers)
+		err := load(cfg, thumbnailsCommand, "thumbnails", os.Args[2:])
+		if err == nil {
+			err = thumbnails(cfg)
+		}
 		if err != nil {
 			fmt.Println(err)
 			fmt.Println()
 			thumbnailsCommand.PrintDefaults()
+			os.Exit(1)
 		}
 	case "serve":
-		serveCommand := flag.NewFlagSet("serve", flag.ExitOnError)
-		photosDirectoryRootPath := serveCommand.String("photos-directory", "", "Root directory for all photos")
-		thumbnailsDirectoryPath := serveCommand.String("thumbnails-directory", "", "Directory to use for thumbnail")
-		httpPort := serveCommand.String("http-port", "8080", "Port to server the app over HTTP")
-		httpsPort := serveCommand.String("https-port", "", "Port to server the app over HTTPS")
-		httpsCertFilePath := serveCommand.String("https-cert-file", "", "Path where HTTPS certificate can be found")
-		httpsCertKeyPath := serveCommand.String("https-cert-key", "", "Path where HTTPS certificate key can be found")
-		dataDirectory := serveCommand.String("data-directory", "", "Directory to store application data")
-		// TODO WFH Passing this here is not good, but better than the hard-coded behavior it had before.
-		accessCode := serveCommand.String("access-code", "", "Access code users will need to access the server")
-
-		serveCommand.Parse(os.Args[2:])
+		cfg := config.Default()
+		serveCommand := cfg.NewFlagSet("serve", "photos-directory", "thumbnails-directory", "thumbnail-sizes", "thumbnail-formats", "thumbnail-quality", "thumbnail-backend", "thumbnail-cache-size", "thumbnail-workers", "display-size", "bind-address", "http-port", "https-port", "unix-socket", "unix-socket-mode", "base-path", "trusted-proxies", "thumbnail-placeholder", "dev", "https-cert-file", "https-cert-key", "data-directory", "access-code", "admin-access-code")
+
+		if err := load(cfg, serveCommand, "serve", os.Args[2:]); err != nil {
+			fmt.Println(err)
+			fmt.Println()
+			serveCommand.PrintDefaults()
+			os.Exit(1)
+		}
 
 		var staticFileSystem http.FileSystem
 		if false {
@@ -106,21 +115,32 @@ func main() {
 			})
 		}
 
-		err := serve(
-			os.ExpandEnv(*dataDirectory),
-			os.ExpandEnv(*photosDirectoryRootPath),
-			os.ExpandEnv(*thumbnailsDirectoryPath),
-			*httpPort,
-			*httpsPort,
-			os.ExpandEnv(*httpsCertFilePath),
-			os.ExpandEnv(*httpsCertKeyPath),
-			*accessCode,
-			staticFileSystem,
-		)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if err := serve(ctx, cfg, staticFileSystem); err != nil {
+			fmt.Println(err)
+			stop()
+			os.Exit(1)
+		}
+	case "config":
+		if len(os.Args) < 3 || os.Args[2] != "print" {
+			fmt.Println("expected 'config print' subcommand")
+			os.Exit(1)
+		}
+
+		cfg := config.Default()
+		printCommand := cfg.NewFlagSet("config print", config.AllOptions...)
+
+		err := cfg.Parse(printCommand, os.Args[3:])
+		if err == nil {
+			err = cfg.Print(os.Stdout)
+		}
 		if err != nil {
 			fmt.Println(err)
 			fmt.Println()
-			serveCommand.PrintDefaults()
+			printCommand.PrintDefaults()
+			os.Exit(1)
 		}
 	default:
 		helpAndExit()
@@ -128,105 +148,135 @@ func main() {
 }
 
 func helpAndExit() {
-	fmt.Println("expected 'index', 'serve', or 'thumbnails' subcommands")
+	fmt.Println("expected 'index', 'serve', 'thumbnails', 'thumbnails verify', or 'config print' subcommands")
 	os.Exit(1)
 }
 
-func index(dataDirectory, photosDirectoryRootPath string, generateThumbnails bool, thumbnailsDirectoryPath string, numWorkers int) error {
-	if photosDirectoryRootPath == "" {
-		return errorInvalidPhotosDirectory
-	}
-	if dataDirectory == "" {
-		return errorInvalidDataDirectory
+// load resolves the effective configuration for a subcommand and validates it.
+func load(cfg *config.Config, flagSet *flag.FlagSet, command string, args []string) error {
+	if err := cfg.Parse(flagSet, args); err != nil {
+		return err
 	}
-	db := datasource.New(dataDirectory)
+
+	return cfg.Validate(command)
+}
+
+func index(cfg *config.Config) error {
+	db := datasource.New(cfg.DataDirectory)
 
 	var thumbnailManager *thumbnail.Manager
-	if generateThumbnails {
-		if err := validateThumbnailConfig(thumbnailsDirectoryPath); err != nil {
-			return err
-		}
-		thumbnailManager = thumbnail.NewManager(db, photosDirectoryRootPath, thumbnailsDirectoryPath)
+	if cfg.GenerateThumbnails {
+		thumbnailManager = newThumbnailManager(db, cfg, nil)
+		defer thumbnailManager.Close()
 	}
 
-	log.Infof("index photos in %q", photosDirectoryRootPath)
+	log.Infof("index photos in %q", cfg.PhotosDirectory)
 
-	indexer := indexer.New(db, photosDirectoryRootPath, thumbnailManager, numWorkers)
+	indexer := indexer.New(context.Background(), db, cfg.PhotosDirectory, thumbnailManager, nil, cfg.Workers)
 	indexer.Scan()
 
 	return nil
 }
 
-func thumbnails(dataDirectory, photosDirectoryRootPath, thumbnailsDirectoryPath string, overwriteExisting bool, numWorkers int) error {
-	if err := validateThumbnailConfig(thumbnailsDirectoryPath); err != nil {
-		return err
-	}
-	if dataDirectory == "" {
-		return errorInvalidDataDirectory
-	}
-	db := datasource.New(dataDirectory)
+func thumbnails(cfg *config.Config) error {
+	db := datasource.New(cfg.DataDirectory)
 
-	log.Infof("generating thumbnails with %d worker(s)", numWorkers)
+	log.Infof("generating thumbnails with %d worker(s)", cfg.Workers)
 
-	thumbnailManager := thumbnail.NewManager(db, photosDirectoryRootPath, thumbnailsDirectoryPath)
-	thumbnailManager.GenerateAll(overwriteExisting, numWorkers)
+	thumbnailManager := newThumbnailManager(db, cfg, nil)
+	defer thumbnailManager.Close()
+	thumbnailManager.GenerateAll(cfg.OverwriteExisting, cfg.Workers)
+	thumbnailManager.Evict(context.Background())
 
 	return nil
 }
 
-func serve(
-	dataDirectory,
-	photosDirectoryRootPath,
-	thumbnailsDirectoryPath,
-	httpPort,
-	httpsPort,
-	httpsCertFilePath,
-	httpsCertKeyPath,
-	accessCode string,
-	staticFileSystem http.FileSystem,
-) error {
-	if err := validateThumbnailConfig(thumbnailsDirectoryPath); err != nil {
+func verifyThumbnails(cfg *config.Config) error {
+	db := datasource.New(cfg.DataDirectory)
+	defer db.Close()
+
+	log.Infof("verifying thumbnails with %d worker(s)", cfg.Workers)
+
+	thumbnailManager := newThumbnailManager(db, cfg, nil)
+	defer thumbnailManager.Close()
+	report, err := thumbnailManager.Verify(cfg.Workers)
+	if err != nil {
 		return err
 	}
-	if dataDirectory == "" {
-		return errorInvalidDataDirectory
+
+	var totalBytes int64
+	for _, usage := range report.Partitions {
+		totalBytes += usage.Bytes
+		log.Infof("[Partition] %d/%s: %d file(s), %d bytes", usage.Size, usage.Partition, usage.Files, usage.Bytes)
 	}
-	db := datasource.New(dataDirectory)
+	log.Infof("[Finished] verified %d, regenerated %d, failed %d, removed %d orphaned and %d temporary file(s), %d bytes in %d partition(s)", report.Verified, report.Regenerated, report.Failed, report.Orphaned, report.Temporary, totalBytes, len(report.Partitions))
 
-	isUsingHTTPS := httpsPort != ""
-	if isUsingHTTPS {
-		if httpsCertFilePath == "" {
-			return errorInvalidCertFilePath
-		}
-		if httpsCertKeyPath == "" {
-			return errorInvalidCertKeyPath
+	return nil
+}
+
+func newThumbnailManager(db *datasource.Database, cfg *config.Config, eventBus *events.Bus) *thumbnail.Manager {
+	// Already checked by cfg.Validate.
+	sizes, _ := cfg.ThumbnailSizeList()
+	formats, _ := cfg.ThumbnailFormatList()
+	thumbnailer, _ := thumbnail.NewThumbnailer(cfg.ThumbnailBackend)
+	cacheSize, _ := cfg.ThumbnailCacheSizeBytes()
+
+	return thumbnail.NewManager(db, cfg.PhotosDirectory, cfg.ThumbnailsDirectory, sizes, cfg.DisplaySize, formats, cfg.ThumbnailQuality, thumbnailer, cfg.ThumbnailWorkers, cacheSize, eventBus)
+}
+
+func serve(ctx context.Context, cfg *config.Config, staticFileSystem http.FileSystem) error {
+	db := datasource.New(cfg.DataDirectory)
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.WithError(err).Error("error closing database")
 		}
-	}
+	}()
 
-	thumbnailManager := thumbnail.NewManager(db, photosDirectoryRootPath, thumbnailsDirectoryPath)
+	// Shared by everything that reports progress to the UI.
+	eventBus := events.NewBus()
+
+	thumbnailManager := newThumbnailManager(db, cfg, eventBus)
+	// Evictions still running at shutdown stop and are waited for before the
+	// database is closed.
+	defer thumbnailManager.Close()
+	// In case the cache size was lowered since the last run.
+	thumbnailManager.StartEvict()
+
+	// For reindexing folders from the API. A scan still running at shutdown
+	// stops and is waited for before the database is closed.
+	indexer := indexer.New(ctx, db, cfg.PhotosDirectory, thumbnailManager, eventBus, cfg.ThumbnailWorkers)
+	defer indexer.Wait()
+
+	// Already checked by cfg.Validate.
+	unixSocketMode, _ := cfg.UnixSocketFileMode()
+	trustedProxies, _ := cfg.TrustedProxyNetworks()
+
+	secret, err := server.LoadSecret(cfg.DataDirectory)
+	if err != nil {
+		return err
+	}
 
 	server := server.New(
 		db,
-		photosDirectoryRootPath,
+		cfg.PhotosDirectory,
 		thumbnailManager,
-		httpPort,
-		httpsPort,
-		httpsCertFilePath,
-		httpsCertKeyPath,
-		accessCode,
+		indexer,
+		eventBus,
+		cfg.BindAddress,
+		cfg.HTTPPort,
+		cfg.HTTPSPort,
+		cfg.UnixSocketPath,
+		unixSocketMode,
+		cfg.BasePath,
+		trustedProxies,
+		cfg.ThumbnailPlaceholder,
+		cfg.Dev,
+		cfg.HTTPSCertFilePath,
+		cfg.HTTPSCertKeyPath,
+		cfg.AccessCode,
+		cfg.AdminAccessCode,
+		secret,
 		staticFileSystem,
 	)
-	return server.Start()
-}
-
-func validateThumbnailConfig(thumbnailsDirectoryPath string) error {
-	thumbnailsDirectory, err := os.Stat(os.ExpandEnv(thumbnailsDirectoryPath))
-	if err != nil {
-		return errorInvalidThumbnailDirectory
-	}
-	if thumbnailsDirectoryPath == "" || !thumbnailsDirectory.IsDir() {
-		return errorInvalidThumbnailDirectory
-	}
-
-	return nil
+	return server.Start(ctx)
 }
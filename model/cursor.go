@@ -0,0 +1,67 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidCursor is returned for a cursor that was not given out by the
+// server.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// PhotoCursor is the position of a photo on the timeline, which is ordered by
+// date and then UUID, newest first.
+type PhotoCursor struct {
+	Date time.Time `json:"d"`
+	UUID string    `json:"u"`
+}
+
+// Encode returns the opaque form of the cursor given to clients. It is safe to
+// use in URLs.
+func (c PhotoCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodePhotoCursor validates and parses a cursor from Encode.
+func DecodePhotoCursor(encoded string) (*PhotoCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor PhotoCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Date.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+	if _, err := uuid.Parse(cursor.UUID); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// Page selects part of a list, as with Relay's connection arguments. Either
+// First or Last is set, and only that many photos are returned after After
+// and before Before.
+type Page struct {
+	First  int
+	Last   int
+	After  *PhotoCursor
+	Before *PhotoCursor
+}
+
+// PhotoPage is a page of photos, newest first, and whether there are more
+// photos on either side of it.
+type PhotoPage struct {
+	Photos          []*Photo
+	HasPreviousPage bool
+	HasNextPage     bool
+}
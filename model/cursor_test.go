@@ -0,0 +1,44 @@
+package model
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestDecodePhotoCursor(t *testing.T) {
+	date := time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC)
+	cursor := PhotoCursor{Date: date, UUID: "0b2c3e0e-8d5a-4b7e-9f1a-2c3d4e5f6a7b"}
+
+	decoded, err := DecodePhotoCursor(cursor.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Date.Equal(date) || decoded.UUID != cursor.UUID {
+		t.Errorf("got %+v, want %+v", decoded, cursor)
+	}
+
+	encode := func(json string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(json))
+	}
+	invalid := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"not base64", "not a cursor!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"d":"2020-06-01T12:30:00Z","u":"0b2c3e0e-8d5a-4b7e-9f1a-2c3d4e5f6a7b"}`))},
+		{"not json", encode("2020-06-01")},
+		{"missing date", encode(`{"u":"0b2c3e0e-8d5a-4b7e-9f1a-2c3d4e5f6a7b"}`)},
+		{"invalid date", encode(`{"d":"yesterday","u":"0b2c3e0e-8d5a-4b7e-9f1a-2c3d4e5f6a7b"}`)},
+		{"missing uuid", encode(`{"d":"2020-06-01T12:30:00Z"}`)},
+		{"invalid uuid", encode(`{"d":"2020-06-01T12:30:00Z","u":"' OR 1=1 --"}`)},
+	}
+	for _, test := range invalid {
+		t.Run(test.name, func(t *testing.T) {
+			if cursor, err := DecodePhotoCursor(test.encoded); err != ErrInvalidCursor {
+				t.Errorf("got %+v and %v, want %v", cursor, err, ErrInvalidCursor)
+			}
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package model
 
 import (
-	"encoding/base64"
+	"context"
 	"github.com/google/uuid"
 	"path/filepath"
 	"time"
@@ -13,6 +13,42 @@ type ContextKey string
 // CtxDB is the context key for the datasource.
 const CtxDB ContextKey = "db"
 
+// CtxThumbnailSizes is the context key for the available thumbnail sizes.
+const CtxThumbnailSizes ContextKey = "thumbnailSizes"
+
+// CtxRole is the context key for the Role of the authenticated user.
+const CtxRole ContextKey = "role"
+
+// CtxUser is the context key for the name of the authenticated user.
+const CtxUser ContextKey = "user"
+
+// Role determines what an authenticated user may do.
+type Role string
+
+const (
+	// RoleViewer may browse photos. Tokens from before roles existed are
+	// viewers.
+	RoleViewer Role = "viewer"
+	// RoleAdmin may also manage the library.
+	RoleAdmin Role = "admin"
+)
+
+// RoleFromContext returns the role of the authenticated user, defaulting to
+// RoleViewer.
+func RoleFromContext(ctx context.Context) Role {
+	if role, ok := ctx.Value(CtxRole).(Role); ok {
+		return role
+	}
+	return RoleViewer
+}
+
+// UserFromContext returns the name of the authenticated user. Tokens issued
+// without a name all share the user "".
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(CtxUser).(string)
+	return user
+}
+
 // Cursorable is the common interface for a record that may have a cursor that
 // references its canonical position in the DB for the sake of "after" type
 // queries.
@@ -20,31 +56,54 @@ type Cursorable interface {
 	Cursor() string
 }
 
-func NewPhoto(date *time.Time, path string) *Photo {
+func NewPhoto(date *time.Time, path string, orientation int) *Photo {
 	return &Photo{
-		UUID:  uuid.New().String(),
-		Path:  path,
-		Name:  filepath.Base(path),
-		Year:  date.Year(),
-		Month: int(date.Month()),
-		Date:  *date,
+		UUID:        uuid.New().String(),
+		Path:        path,
+		Name:        filepath.Base(path),
+		Year:        date.Year(),
+		Month:       int(date.Month()),
+		Day:         date.Day(),
+		Date:        *date,
+		Orientation: orientation,
 	}
 }
 
 // Photo tracks essential fields and adds helpers around photo records.
 type Photo struct {
-	UUID       string
-	Path       string
-	Name       string
-	CursorData string `db:"cursor"`
-	Year       int
-	Month      int
-	Date       time.Time
+	UUID  string
+	Path  string
+	Name  string
+	Year  int
+	Month int
+	Day   int
+	Date  time.Time
+	// Orientation is the EXIF orientation, 1 through 8. 1 is upright.
+	Orientation int
+	// BlurHash, DominantColor (as #rrggbb) and AspectRatio (width / height,
+	// upright) are set when thumbnails are generated. They are empty until then.
+	BlurHash      string  `db:"blurhash"`
+	DominantColor string  `db:"dominant_color"`
+	AspectRatio   float64 `db:"aspect_ratio"`
+	// Hidden photos are left out of buckets. They are still in the DB, and
+	// on disk, and may be unhidden.
+	Hidden  bool
+	Caption string
 }
 
 // Cursor returns the opaque cursor id for the record.
 func (p *Photo) Cursor() string {
-	return base64.StdEncoding.EncodeToString([]byte(p.CursorData))
+	return PhotoCursor{Date: p.Date, UUID: p.UUID}.Encode()
+}
+
+// Thumbnail tracks a generated thumbnail file for cache eviction.
+type Thumbnail struct {
+	// Path is relative to the thumbnails directory.
+	Path  string
+	UUID  string
+	Bytes int64
+	// LastAccess is when the thumbnail was last served, in Unix nanoseconds.
+	LastAccess int64 `db:"last_access"`
 }
 
 type YearMonthBucket struct {
@@ -52,5 +111,74 @@ type YearMonthBucket struct {
 	Year       int
 	Month      int
 	TotalCount int `db:"total_count"`
-	PhotoUuids []string
+}
+
+// Granularity is how the timeline is split into buckets.
+type Granularity string
+
+const (
+	GranularityYear  Granularity = "year"
+	GranularityMonth Granularity = "month"
+	GranularityDay   Granularity = "day"
+	// GranularityEvent groups photos taken close together. A new bucket starts
+	// wherever there is a long enough gap between photos.
+	GranularityEvent Granularity = "event"
+)
+
+// Bucket is a range of the timeline. The ID is YYYY, YYYY-MM or YYYY-MM-DD for
+// calendar buckets. For events it is the interval from the oldest to the
+// newest photo, e.g. 2020-06-14T10:00:00/2020-06-15T18:30:00. TotalCount and
+// the photos in the bucket only include those matching the Filter, which is
+// nil for every photo.
+type Bucket struct {
+	ID          string
+	Granularity Granularity
+	TotalCount  int          `db:"total_count"`
+	Filter      *PhotoFilter `db:"-"`
+}
+
+// Memory is the photos taken around the same day of the year in an earlier
+// year. Year is the date's year less YearsAgo. Photos from around New Year may
+// have been taken in the year before or after it. TotalCount may be more than
+// the photos included.
+type Memory struct {
+	Year       int
+	YearsAgo   int
+	TotalCount int
+	Photos     []*Photo
+}
+
+// PhotoFilter narrows down photos. The zero value matches every photo.
+type PhotoFilter struct {
+	// Folder is relative to the photos directory. Photos in its subfolders
+	// match too.
+	Folder string
+	// From and To are inclusive dates, as YYYY-MM-DD.
+	From string
+	To   string
+	// Favorites only matches the user's favorite photos, and MinRating those
+	// the user rated at least that many stars. A MinRating of 0 matches
+	// unrated photos too.
+	Favorites bool
+	MinRating int
+}
+
+// MaxRating is the highest star rating of a photo. 0 is unrated.
+const MaxRating = 5
+
+// PhotoUserState is what a single user has marked a photo as. Photos a user
+// has not marked have the zero value. Unlike Photo.Hidden, which hides a photo
+// from everyone, Hidden only hides it from this user.
+type PhotoUserState struct {
+	PhotoUUID string `db:"photo_uuid"`
+	Favorite  bool
+	Rating    int
+	Hidden    bool
+}
+
+// Tag is a person or topic photos are tagged with. TotalCount is the number of
+// photos with the tag that are visible to the user.
+type Tag struct {
+	Name       string
+	TotalCount int `db:"total_count"`
 }
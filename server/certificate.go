@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certificateReloader keeps an HTTPS certificate in memory and swaps it out
+// whenever the certificate or key on disk change (e.g. after a certbot renewal)
+// or when the process receives SIGHUP.
+type certificateReloader struct {
+	certFilePath string
+	keyFilePath  string
+	interval     time.Duration
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// newCertificateReloader loads the initial certificate. An error is returned if
+// the initial pair is not valid since there is nothing to fall back to.
+func newCertificateReloader(certFilePath, keyFilePath string) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certFilePath: certFilePath,
+		keyFilePath:  keyFilePath,
+		interval:     time.Minute,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate.
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.certificate, nil
+}
+
+// Watch polls the certificate files for changes and listens for SIGHUP. Either
+// triggers a reload. A failed reload keeps the previous certificate in place.
+// Watching stops when the context is done.
+func (c *certificateReloader) Watch(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(c.interval)
+
+	go func() {
+		defer signal.Stop(hangup)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				log.Info("received SIGHUP, reloading https certificate")
+				if err := c.reload(); err != nil {
+					log.WithError(err).Error("error reloading https certificate")
+				}
+			case <-ticker.C:
+				if !c.hasChanged() {
+					continue
+				}
+				log.Info("https certificate changed on disk, reloading")
+				if err := c.reload(); err != nil {
+					log.WithError(err).Error("error reloading https certificate")
+				}
+			}
+		}
+	}()
+}
+
+func (c *certificateReloader) hasChanged() bool {
+	certStat, err := os.Stat(c.certFilePath)
+	if err != nil {
+		log.WithError(err).Warnf("error checking https certificate %q", c.certFilePath)
+		return false
+	}
+	keyStat, err := os.Stat(c.keyFilePath)
+	if err != nil {
+		log.WithError(err).Warnf("error checking https certificate key %q", c.keyFilePath)
+		return false
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return !certStat.ModTime().Equal(c.certModTime) || !keyStat.ModTime().Equal(c.keyModTime)
+}
+
+// reload validates the pair on disk before swapping it in.
+func (c *certificateReloader) reload() error {
+	// Stat first so a write that lands mid-load is picked up on the next tick.
+	certStat, err := os.Stat(c.certFilePath)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(c.keyFilePath)
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certFilePath, c.keyFilePath)
+	if err != nil {
+		return fmt.Errorf("invalid https certificate pair: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("invalid https certificate: %w", err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("https certificate expired on %v", leaf.NotAfter)
+	}
+	certificate.Leaf = leaf
+
+	c.mutex.Lock()
+	c.certificate = &certificate
+	c.certModTime = certStat.ModTime()
+	c.keyModTime = keyStat.ModTime()
+	c.mutex.Unlock()
+
+	log.Infof("loaded https certificate for %q, expires %v", leaf.Subject.CommonName, leaf.NotAfter)
+
+	return nil
+}
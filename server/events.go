@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/events"
+	"github.com/williamhaley/photo-server/model"
+)
+
+// keepAliveInterval is how often a comment is sent on an idle event stream so
+// proxies do not close it.
+const keepAliveInterval = 30 * time.Second
+
+// Events streams server events, like indexing progress and new photos, as
+// server-sent events. Browsers reconnect on their own with the Last-Event-ID
+// header, and events missed in between are replayed if they are recent.
+func (s *Server) Events(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeError(rw, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	var lastID uint64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		lastID, _ = strconv.ParseUint(header, 10, 64)
+	}
+	subscription := s.events.Subscribe(lastID)
+	defer subscription.Close()
+
+	isAdmin := model.RoleFromContext(r.Context()) == model.RoleAdmin
+	user := model.UserFromContext(r.Context())
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-store")
+	// Stop nginx from buffering the stream.
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.shutdown:
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-subscription.C:
+			if !ok {
+				// Fell behind. The client reconnects and catches up.
+				return
+			}
+			// Viewers may not see photos hidden for everyone, and nobody sees
+			// the photos they hid themselves, so to them a photo being hidden
+			// is the same as it being removed.
+			if photo, ok := event.Data.(events.Photo); ok && event.Type != events.PhotoRemoved {
+				if (photo.Hidden && !isAdmin) || s.hiddenByUser(user, photo.UUID) {
+					event.Type = events.PhotoRemoved
+					event.Data = events.Photo{UUID: photo.UUID}
+				}
+			}
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				log.WithError(err).Errorf("error encoding %q event", event.Type)
+				continue
+			}
+			if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// hiddenByUser returns whether the user hid the photo for themselves. A photo
+// whose state cannot be loaded is treated as hidden.
+func (s *Server) hiddenByUser(user, uuid string) bool {
+	states, err := s.db.PhotoUserStates(user, uuid)
+	if err != nil {
+		log.WithError(err).Errorf("error loading the state of photo %q", uuid)
+		return true
+	}
+	return states[0].Hidden
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxGraphQLRequestBytes limits the size of a GraphQL request body.
+const maxGraphQLRequestBytes = 1 << 20
+
+// graphQLRequest is the standard GraphQL over HTTP request body.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// GraphQL executes a GraphQL request. As is conventional for GraphQL, errors
+// in the query itself are returned in the "errors" field with a 200.
+func (s *Server) GraphQL(rw http.ResponseWriter, r *http.Request) {
+	var request graphQLRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxGraphQLRequestBytes))
+	if err := decoder.Decode(&request); err != nil {
+		log.WithError(err).Error("error decoding graphql request")
+		writeError(rw, http.StatusBadRequest, "invalid graphql request")
+		return
+	}
+	if request.Query == "" {
+		writeError(rw, http.StatusBadRequest, "missing graphql query")
+		return
+	}
+
+	result := s.api.Execute(r.Context(), request.Query, request.OperationName, request.Variables)
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(result); err != nil {
+		log.WithError(err).Error("error writing response")
+	}
+}
+
+// GraphiQL serves an in-browser GraphQL IDE. It is only available in dev mode.
+// Open /graphql?token=... so that queries, which post back to the same URL,
+// are authenticated.
+func (s *Server) GraphiQL(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	if _, err := rw.Write([]byte(graphiQLPage)); err != nil {
+		log.WithError(err).Error("error writing response")
+	}
+}
+
+const graphiQLPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8" />
+  <title>photo-server GraphiQL</title>
+  <link href="https://unpkg.com/graphiql@1.4.7/graphiql.min.css" rel="stylesheet" />
+  <style>
+    body { margin: 0; }
+    #graphiql { height: 100vh; }
+  </style>
+  <script crossorigin src="https://unpkg.com/react@17.0.2/umd/react.production.min.js"></script>
+  <script crossorigin src="https://unpkg.com/react-dom@17.0.2/umd/react-dom.production.min.js"></script>
+  <script crossorigin src="https://unpkg.com/graphiql@1.4.7/graphiql.min.js"></script>
+</head>
+<body>
+  <div id="graphiql">Loading...</div>
+  <script>
+    const fetcher = GraphiQL.createFetcher({ url: window.location.href });
+    ReactDOM.render(React.createElement(GraphiQL, { fetcher: fetcher }), document.getElementById('graphiql'));
+  </script>
+</body>
+</html>
+`
@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
-	"io"
+	"fmt"
+	"html"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -11,15 +14,33 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
 	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/model"
+	"github.com/williamhaley/photo-server/thumbnail"
 )
 
+// placeholderThumbnail stands in for thumbnails that cannot be served.
+const placeholderThumbnail = `<svg xmlns="http://www.w3.org/2000/svg" width="200" height="200" viewBox="0 0 200 200">
+<rect width="200" height="200" fill="#e0e0e0"/>
+<path d="M60 135l25-30 18 22 14-16 23 24z" fill="#bdbdbd"/>
+<circle cx="122" cy="78" r="10" fill="#bdbdbd"/>
+</svg>
+`
+
+// maxUserLength is the longest user name that may log in.
+const maxUserLength = 64
+
 func (s *Server) LogIn(rw http.ResponseWriter, r *http.Request) {
+	// The user name is optional. It keeps the favorites, ratings and hidden
+	// photos of people sharing an access code apart.
 	loginData := struct {
 		AccessCode string `json:"accessCode"`
+		User       string `json:"user"`
 	}{}
 
 	err := json.NewDecoder(r.Body).Decode(&loginData)
@@ -34,7 +55,13 @@ func (s *Server) LogIn(rw http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if loginData.AccessCode != s.accessCode {
+	var role model.Role
+	switch {
+	case s.adminAccessCode != "" && loginData.AccessCode == s.adminAccessCode:
+		role = model.RoleAdmin
+	case loginData.AccessCode == s.accessCode:
+		role = model.RoleViewer
+	default:
 		rw.WriteHeader(http.StatusUnauthorized)
 		result := map[string]string{
 			"error": "access denied",
@@ -45,14 +72,24 @@ func (s *Server) LogIn(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user := strings.TrimSpace(loginData.User)
+	if utf8.RuneCountInString(user) > maxUserLength {
+		writeError(rw, http.StatusBadRequest, fmt.Sprintf("user must be at most %d characters", maxUserLength))
+		return
+	}
+
 	// create the token
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := make(jwt.MapClaims)
 	claims["foo"] = "bar"
+	claims["role"] = string(role)
+	if user != "" {
+		claims["user"] = user
+	}
 	claims["exp"] = time.Now().Add(time.Hour * 24 * 60).Unix() // 2 months
 	token.Claims = claims
 
-	tokenString, err := token.SignedString([]byte(s.secret))
+	tokenString, err := token.SignedString(s.secret)
 	if err != nil {
 		log.WithError(err).Error("error signing token")
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -71,6 +108,8 @@ func (s *Server) LogIn(rw http.ResponseWriter, r *http.Request) {
 func (s *Server) Profile(rw http.ResponseWriter, r *http.Request) {
 	result := map[string]string{
 		"status": "ok",
+		"role":   string(model.RoleFromContext(r.Context())),
+		"user":   model.UserFromContext(r.Context()),
 	}
 
 	if err := json.NewEncoder(rw).Encode(result); err != nil {
@@ -78,7 +117,32 @@ func (s *Server) Profile(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) HTTPtoHTTPSRedirect(rw http.ResponseWriter, r *http.Request) {
+// HTTPtoHTTPSRedirect redirects requests over plain HTTP to HTTPS. The scheme
+// of the request is only set when a trusted proxy forwarded it (see
+// ProxyHeadersMiddleware). Requests the proxy received over HTTPS are passed
+// to next, and those it received over HTTP are redirected to the host the
+// proxy was asked for, on the default HTTPS port.
+func (s *Server) HTTPtoHTTPSRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Scheme {
+		case "https":
+			next.ServeHTTP(rw, r)
+		case "http":
+			host := r.Host
+			if hostWithoutPort, _, err := net.SplitHostPort(host); err == nil {
+				host = hostWithoutPort
+			}
+			redirectURL := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+			http.Redirect(rw, r, redirectURL.String(), http.StatusMovedPermanently)
+		default:
+			s.redirectToHTTPSPort(rw, r)
+		}
+	})
+}
+
+// redirectToHTTPSPort redirects a request made directly to the HTTP port to
+// the same host on the HTTPS port.
+func (s *Server) redirectToHTTPSPort(rw http.ResponseWriter, r *http.Request) {
 	// The original request having a port (like :8080) implies dev/non-prod.
 	hasPort := strings.Contains(r.Host, ":")
 
@@ -104,7 +168,7 @@ func (s *Server) HTTPtoHTTPSRedirect(rw http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) BucketCounts(rw http.ResponseWriter, r *http.Request) {
-	result, err := s.api.BucketCounts()
+	result, err := s.api.BucketCounts(r.Context())
 	if err != nil {
 		log.WithError(err).Error("error retrieving bucket counts")
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -116,6 +180,20 @@ func (s *Server) BucketCounts(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ThumbnailStats reports the thumbnail cache usage and hit/miss counters.
+func (s *Server) ThumbnailStats(rw http.ResponseWriter, r *http.Request) {
+	result, err := s.thumbnailManager.Stats()
+	if err != nil {
+		log.WithError(err).Error("error retrieving thumbnail stats")
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(rw).Encode(result); err != nil {
+		log.WithError(err).Error("error writing response")
+	}
+}
+
 func (s *Server) PhotosForBucket(rw http.ResponseWriter, r *http.Request) {
 	bucketID := chi.URLParam(r, "id")
 	after := r.URL.Query().Get("after")
@@ -126,7 +204,7 @@ func (s *Server) PhotosForBucket(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := s.api.BucketPhotos(bucketID, photosAfter)
+	result, err := s.api.BucketPhotos(r.Context(), bucketID, photosAfter)
 	if err != nil {
 		log.WithError(err).Errorf("error retrieving photos for bucket %q", bucketID)
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -138,87 +216,196 @@ func (s *Server) PhotosForBucket(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// StaticHandler serves the UI. The index page is given a <base> element for the
+// base path so all of the UI's relative URLs resolve beneath it.
+func (s *Server) StaticHandler() http.Handler {
+	fileServer := http.StripPrefix(s.basePath, http.FileServer(s.staticFileSystem))
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, s.basePath) {
+		case "", "/", "/index.html":
+			s.Index(rw, r)
+		default:
+			fileServer.ServeHTTP(rw, r)
+		}
+	})
+}
+
+// Index responds with the UI's index page.
+func (s *Server) Index(rw http.ResponseWriter, r *http.Request) {
+	file, err := s.staticFileSystem.Open("index.html")
+	if err != nil {
+		log.WithError(err).Error("could not open index")
+		http.Error(rw, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	index, err := ioutil.ReadAll(file)
+	if err != nil {
+		log.WithError(err).Error("could not read index")
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	base := fmt.Sprintf(`<head><base href="%s/">`, html.EscapeString(s.basePath))
+	index = bytes.Replace(index, []byte("<head>"), []byte(base), 1)
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Write(index)
+}
+
 // FullImageHandler responds to HTTP requests for full resolution single images.
 func (s *Server) FullImageHandler(rw http.ResponseWriter, r *http.Request) {
 	uuid := chi.URLParam(r, "uuid")
 	if uuid == "" {
-		http.Error(rw, "Get 'uuid' not specified in url.", http.StatusBadRequest)
+		writeError(rw, http.StatusBadRequest, "uuid not specified in url")
 		return
 	}
 
 	photo, err := s.db.GetPhoto(uuid)
+	if err == datasource.ErrNotFound {
+		writeError(rw, http.StatusNotFound, "photo not found")
+		return
+	}
 	if err != nil {
 		log.WithError(err).Errorf("could not find photo %q", uuid)
+		writeError(rw, http.StatusInternalServerError, "error loading photo")
 		return
 	}
 
 	file, err := os.Open(filepath.Join(s.photosDirectoryRootPath, photo.Path))
+	if os.IsNotExist(err) {
+		writeError(rw, http.StatusGone, "photo was removed")
+		return
+	}
 	if err != nil {
 		log.WithError(err).Error("could not open source image")
+		writeError(rw, http.StatusInternalServerError, "error opening photo")
 		return
 	}
 	defer file.Close()
 
-	header := make([]byte, 512)
-	file.Read(header)
-	contentType := http.DetectContentType(header)
-
-	rw.Header().Set("Content-Type", contentType)
+	// Originals may be edited in place, so always revalidate with the ETag.
+	serveImage(rw, r, uuid, file, "no-cache")
+}
 
-	stat, err := file.Stat()
-	if err != nil {
-		log.WithError(err).Error("error getting file stats")
-		return
+// ThumbnailHandler responds to HTTP requests for image thumbnails. The smallest
+// rendition is used unless a size is specified in the url.
+func (s *Server) ThumbnailHandler(rw http.ResponseWriter, r *http.Request) {
+	size := s.thumbnailManager.DefaultSize()
+	if sizeParam := chi.URLParam(r, "size"); sizeParam != "" {
+		var err error
+		size, err = strconv.Atoi(sizeParam)
+		if err != nil || !s.thumbnailManager.HasSize(size) {
+			s.thumbnailError(rw, http.StatusNotFound, "thumbnail size not found")
+			return
+		}
 	}
-	size := strconv.FormatInt(stat.Size(), 10)
-	rw.Header().Set("Content-Length", size)
 
-	//Send the file
-	//We read 512 bytes from the file already, so we reset the offset back to 0
-	file.Seek(0, 0)
-	io.Copy(rw, file)
-	return
+	s.serveRendition(rw, r, size)
 }
 
-// ThumbnailHandler responds to HTTP requests for image thumbnails.
-func (s *Server) ThumbnailHandler(rw http.ResponseWriter, r *http.Request) {
+// DisplayHandler responds to HTTP requests for viewing a single photo. The
+// display rendition is upright, unlike the original, regardless of whether or
+// not the browser respects EXIF orientation.
+func (s *Server) DisplayHandler(rw http.ResponseWriter, r *http.Request) {
+	s.serveRendition(rw, r, s.thumbnailManager.DisplaySize())
+}
+
+// serveRendition responds with a rendition of the photo in the url, generating
+// it if needed.
+func (s *Server) serveRendition(rw http.ResponseWriter, r *http.Request, size int) {
 	uuid := chi.URLParam(r, "uuid")
 	if uuid == "" {
-		http.Error(rw, "Get 'uuid' not specified in url.", http.StatusBadRequest)
+		s.thumbnailError(rw, http.StatusBadRequest, "uuid not specified in url")
 		return
 	}
 
+	s.servePhotoRendition(rw, r, uuid, size, "public, max-age=31536000, immutable")
+}
+
+// servePhotoRendition responds with a rendition of the photo, generating it if
+// needed.
+func (s *Server) servePhotoRendition(rw http.ResponseWriter, r *http.Request, uuid string, size int, cacheControl string) {
 	photo, err := s.db.GetPhoto(uuid)
+	if err == datasource.ErrNotFound {
+		s.thumbnailError(rw, http.StatusNotFound, "photo not found")
+		return
+	}
 	if err != nil {
 		log.WithError(err).Errorf("could not find photo %q", uuid)
+		s.thumbnailError(rw, http.StatusInternalServerError, "error loading photo")
 		return
 	}
 
+	// The response depends on the Accept header, so caches must key on it.
+	rw.Header().Add("Vary", "Accept")
+	format := thumbnail.Negotiate(r.Header.Get("Accept"), s.thumbnailManager.Formats())
+
 	overwrite := false
-	file, _, err := s.thumbnailManager.Generate(photo, overwrite)
+	file, _, err := s.thumbnailManager.Generate(photo, size, format, overwrite)
+	if err == thumbnail.ErrSourceNotFound {
+		s.thumbnailError(rw, http.StatusGone, "photo was removed")
+		return
+	}
 	if err != nil {
 		log.WithError(err).Error("could not get thumbnail")
+		s.thumbnailError(rw, http.StatusInternalServerError, "error generating thumbnail")
 		return
 	}
 	defer file.Close()
 
-	header := make([]byte, 512)
-	file.Read(header)
-	contentType := http.DetectContentType(header)
+	rw.Header().Set("Content-Type", format.ContentType())
+	// Rotating a photo changes its renditions.
+	etagKey := fmt.Sprintf("%s-%d-%d-%s", uuid, size, photo.Orientation, format)
+	serveImage(rw, r, etagKey, file, cacheControl)
+}
 
-	rw.Header().Set("Content-Type", contentType)
+// thumbnailError responds with the placeholder image, if enabled, so the UI
+// can degrade gracefully. Otherwise it responds with a JSON error.
+func (s *Server) thumbnailError(rw http.ResponseWriter, status int, message string) {
+	if !s.thumbnailPlaceholder {
+		writeError(rw, status, message)
+		return
+	}
+
+	// The status still reflects the error. Browsers render the image anyway.
+	rw.Header().Set("Content-Type", "image/svg+xml")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	rw.Write([]byte(placeholderThumbnail))
+}
 
+// writeError responds with a JSON error body.
+func writeError(rw http.ResponseWriter, status int, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	result := map[string]string{
+		"error": message,
+	}
+	if err := json.NewEncoder(rw).Encode(result); err != nil {
+		log.WithError(err).Error("error writing response")
+	}
+}
+
+// serveImage writes the image with caching headers. http.ServeContent takes
+// care of the content type, conditional requests (304s) and byte ranges. The
+// key uniquely identifies the image, e.g. the photo UUID.
+func serveImage(rw http.ResponseWriter, r *http.Request, key string, file *os.File, cacheControl string) {
 	stat, err := file.Stat()
 	if err != nil {
 		log.WithError(err).Error("error getting file stats")
+		writeError(rw, http.StatusInternalServerError, "error reading image")
 		return
 	}
-	size := strconv.FormatInt(stat.Size(), 10)
-	rw.Header().Set("Content-Length", size)
 
-	//Send the file
-	//We read 512 bytes from the file already, so we reset the offset back to 0
-	file.Seek(0, 0)
-	io.Copy(rw, file)
-	return
+	// Strong ETag. The key identifies the image, the modification time and
+	// size change whenever the file on disk is replaced.
+	etag := fmt.Sprintf(`"%s-%x-%x"`, key, stat.ModTime().UnixNano(), stat.Size())
+
+	rw.Header().Set("ETag", etag)
+	rw.Header().Set("Cache-Control", cacheControl)
+
+	http.ServeContent(rw, r, stat.Name(), stat.ModTime(), file)
 }
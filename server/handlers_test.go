@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeImageStatError(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "image.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stat fails on a closed file.
+	file.Close()
+
+	recorder := httptest.NewRecorder()
+	serveImage(recorder, httptest.NewRequest(http.MethodGet, "/full/image.jpg", nil), "image", file, "no-cache")
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+}
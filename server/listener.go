@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shutdownTimeout is how long in-flight requests are given to finish once
+// shutdown begins.
+const shutdownTimeout = 30 * time.Second
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation. See sd_listen_fds(3).
+const listenFdsStart = 3
+
+// listener pairs an HTTP server with the socket it accepts connections on.
+type listener struct {
+	name     string
+	server   *http.Server
+	listener net.Listener
+	tls      bool
+}
+
+func (l *listener) serve() error {
+	if l.tls {
+		// The certificate comes from TLSConfig.GetCertificate so it can be reloaded.
+		return l.server.ServeTLS(l.listener, "", "")
+	}
+	return l.server.Serve(l.listener)
+}
+
+// run serves every listener until the context is done or any one of them
+// fails. Either way, all listeners are then shut down gracefully. The first
+// listener failure, if any, is returned.
+func run(ctx context.Context, listeners ...*listener) error {
+	errChan := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			err := l.serve()
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			if err != nil {
+				err = fmt.Errorf("error serving %s traffic: %w", l.name, err)
+			}
+			errChan <- err
+		}(l)
+	}
+
+	var firstErr error
+	remaining := len(listeners)
+
+	select {
+	case <-ctx.Done():
+		log.Info("shutting down, draining in-flight requests")
+	case firstErr = <-errChan:
+		remaining--
+		log.WithError(firstErr).Error("listener stopped, shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, l := range listeners {
+		if err := l.server.Shutdown(shutdownCtx); err != nil {
+			log.WithError(err).Errorf("error shutting down %s server", l.name)
+		}
+	}
+
+	for ; remaining > 0; remaining-- {
+		if err := <-errChan; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// listenUnix binds a Unix domain socket, replacing a stale socket file left
+// behind by a previous run, and applies the requested permissions.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if stat, err := os.Stat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	unixListener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		unixListener.Close()
+		return nil, err
+	}
+
+	return unixListener, nil
+}
+
+// activatedListeners returns the sockets passed in by systemd socket
+// activation, keyed by name. Sockets are named with FileDescriptorName= in the
+// socket unit. Unnamed sockets are treated as "http" then "https" in the order
+// they are passed.
+func activatedListeners() (map[string]net.Listener, error) {
+	listeners := map[string]net.Listener{}
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return listeners, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// The variables only apply to this process.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	unnamed := []string{"http", "https"}
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) && (names[i] == "http" || names[i] == "https") {
+			name = names[i]
+		} else if len(unnamed) > 0 {
+			name = unnamed[0]
+		}
+		for j, candidate := range unnamed {
+			if candidate == name {
+				unnamed = append(unnamed[:j], unnamed[j+1:]...)
+				break
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("unexpected socket activation file descriptor %d", listenFdsStart+i)
+		}
+
+		file := os.NewFile(uintptr(listenFdsStart+i), name)
+		activated, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error using socket activation file descriptor %d: %w", listenFdsStart+i, err)
+		}
+		listeners[name] = activated
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/model"
+)
+
+// memoriesPhotosPerYear caps the photos shown for each year in the digest.
+const memoriesPhotosPerYear = 24
+
+// Memories serves a daily digest page of photos taken on this day in earlier
+// years. Open /memories?token=... in a browser. The date (YYYY-MM-DD) and
+// windowDays query parameters pick another day or widen the window.
+func (s *Server) Memories(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	windowDays := 0
+	if window := query.Get("windowDays"); window != "" {
+		var err error
+		if windowDays, err = strconv.Atoi(window); err != nil {
+			http.Error(rw, "invalid windowDays", http.StatusBadRequest)
+			return
+		}
+	}
+
+	memories, err := s.api.Memories(r.Context(), query.Get("date"), windowDays, memoriesPhotosPerYear)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	if err := memoriesTemplate.Execute(rw, struct {
+		Memories []*model.Memory
+	}{memories}); err != nil {
+		log.WithError(err).Error("error writing response")
+	}
+}
+
+// Links are relative, so they resolve beneath the base path.
+var memoriesTemplate = template.Must(template.New("memories").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8" />
+  <meta name="viewport" content="width=device-width, initial-scale=1" />
+  <title>On this day</title>
+  <style>
+    body { font-family: sans-serif; margin: 1em; }
+    .photos { display: flex; flex-wrap: wrap; gap: 4px; }
+    .photos img { height: 160px; display: block; }
+  </style>
+</head>
+<body>
+  <h1>On this day</h1>
+  {{range .Memories}}
+    <h2>{{.YearsAgo}} year{{if ne .YearsAgo 1}}s{{end}} ago, {{.Year}}</h2>
+    <p>{{.TotalCount}} photo{{if ne .TotalCount 1}}s{{end}}</p>
+    <div class="photos">
+      {{range .Photos}}
+        <a href="display/{{.UUID}}?o={{.Orientation}}"><img src="thumbnail/{{.UUID}}.jpg?o={{.Orientation}}" loading="lazy" alt="{{.Caption}}"{{if .DominantColor}} style="background-color: {{.DominantColor}}"{{end}} /></a>
+      {{end}}
+    </div>
+  {{else}}
+    <p>No photos from this day in earlier years.</p>
+  {{end}}
+</body>
+</html>
+`))
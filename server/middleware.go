@@ -1,13 +1,20 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/dgrijalva/jwt-go"
 	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/model"
 )
 
-func TokenMiddleware(secret string) func(http.Handler) http.Handler {
+// TokenMiddleware rejects requests without a token signed with the secret and
+// puts the role and user of the token in the request context.
+func TokenMiddleware(secret []byte) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 			tokenString := r.URL.Query().Get("token")
@@ -16,7 +23,10 @@ func TokenMiddleware(secret string) func(http.Handler) http.Handler {
 			}
 
 			token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-				return []byte(secret), nil
+				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+				}
+				return secret, nil
 			})
 			if err != nil || !token.Valid {
 				log.WithError(err).Errorf("token is invalid")
@@ -24,7 +34,99 @@ func TokenMiddleware(secret string) func(http.Handler) http.Handler {
 				return
 			}
 
+			// Tokens from before roles existed have no role and are viewers.
+			// Tokens without a user share the user "".
+			role, user := model.RoleViewer, ""
+			if claims, ok := token.Claims.(jwt.MapClaims); ok {
+				if claims["role"] == string(model.RoleAdmin) {
+					role = model.RoleAdmin
+				}
+				user, _ = claims["user"].(string)
+			}
+			ctx := context.WithValue(r.Context(), model.CtxRole, role)
+			ctx = context.WithValue(ctx, model.CtxUser, user)
+
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
+	}
+}
+
+// ProxyHeadersMiddleware applies the X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-For headers to the request, but only when the request came
+// directly from a trusted proxy. Everything downstream (redirects, logging)
+// then sees the original scheme, host and client address. Connections over a
+// Unix domain socket can only come from the local machine and are trusted.
+func ProxyHeadersMiddleware(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			isUnixSocket := r.RemoteAddr == "" || r.RemoteAddr == "@"
+			if !isUnixSocket && !isTrustedProxy(remoteIP(r.RemoteAddr), trustedProxies) {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			switch proto := strings.ToLower(firstHeaderValue(r, "X-Forwarded-Proto")); proto {
+			case "http", "https":
+				r.URL.Scheme = proto
+			}
+			if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+				r.Host = host
+			}
+			if clientIP := forwardedClientIP(r, trustedProxies); clientIP != "" {
+				r.RemoteAddr = clientIP
+			}
+
 			next.ServeHTTP(rw, r)
 		})
 	}
 }
+
+// forwardedClientIP walks X-Forwarded-For from the nearest hop outward and
+// returns the first address that is not a trusted proxy. Anything further out
+// than that was supplied by the client and cannot be trusted.
+func forwardedClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			return ""
+		}
+		if i == 0 || !isTrustedProxy(ip, trustedProxies) {
+			return ip.String()
+		}
+	}
+
+	return ""
+}
+
+func firstHeaderValue(r *http.Request, name string) string {
+	return strings.TrimSpace(strings.Split(r.Header.Get(name), ",")[0])
+}
+
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/williamhaley/photo-server/model"
+)
+
+func TestTokenMiddleware(t *testing.T) {
+	secret, err := LoadSecret(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		secret:          secret,
+		accessCode:      "viewer-code",
+		adminAccessCode: "admin-code",
+	}
+
+	login := httptest.NewRecorder()
+	s.LogIn(login, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"accessCode":"admin-code"}`)))
+	var result map[string]string
+	if err := json.NewDecoder(login.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(key interface{}, method jwt.SigningMethod) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{
+			"role": string(model.RoleAdmin),
+			"exp":  time.Now().Add(time.Hour).Unix(),
+		})
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{"issued by login", result["token"], http.StatusOK},
+		{"signed with the access code", sign([]byte("viewer-code"), jwt.SigningMethodHS256), http.StatusUnauthorized},
+		{"signed with the admin access code", sign([]byte("admin-code"), jwt.SigningMethodHS256), http.StatusUnauthorized},
+		{"unsigned", sign(jwt.UnsafeAllowNoneSignatureType, jwt.SigningMethodNone), http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var role model.Role
+			handler := TokenMiddleware(s.secret)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				role = model.RoleFromContext(r.Context())
+			}))
+			request := httptest.NewRequest(http.MethodGet, "/api/profile", nil)
+			request.Header.Set("Authorization", test.token)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if test.wantStatus == http.StatusOK && role != model.RoleAdmin {
+				t.Errorf("role = %q, want %q", role, model.RoleAdmin)
+			}
+		})
+	}
+}
+
+func TestLoadSecret(t *testing.T) {
+	directory := t.TempDir()
+	first, err := LoadSecret(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != secretLength {
+		t.Fatalf("len(secret) = %d, want %d", len(first), secretLength)
+	}
+	second, err := LoadSecret(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != string(second) {
+		t.Error("secret changed between loads")
+	}
+}
+
+func TestHTTPtoHTTPSRedirect(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s := &Server{httpsPort: "8443"}
+	handler := ProxyHeadersMiddleware([]*net.IPNet{loopback})(s.HTTPtoHTTPSRedirect(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})))
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		host         string
+		headers      map[string]string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"direct", "192.0.2.1:1234", "example.com:8080", nil, http.StatusMovedPermanently, "https://example.com:8443/photos?a=b"},
+		{"direct without port", "192.0.2.1:1234", "example.com", nil, http.StatusMovedPermanently, "https://example.com/photos?a=b"},
+		{"proxied https", "127.0.0.1:1234", "localhost:8080", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "photos.example.com"}, http.StatusOK, ""},
+		{"proxied http", "127.0.0.1:1234", "localhost:8080", map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "photos.example.com:80"}, http.StatusMovedPermanently, "https://photos.example.com/photos?a=b"},
+		{"untrusted https", "192.0.2.1:1234", "example.com:8080", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com"}, http.StatusMovedPermanently, "https://example.com:8443/photos?a=b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/photos?a=b", nil)
+			request.RemoteAddr = test.remoteAddr
+			request.Host = test.host
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if location := recorder.Header().Get("Location"); location != test.wantLocation {
+				t.Errorf("Location = %q, want %q", location, test.wantLocation)
+			}
+		})
+	}
+}
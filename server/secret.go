@@ -0,0 +1,61 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// secretFileName is the file in the data directory holding the key tokens are
+// signed with.
+const secretFileName = "secret"
+
+// secretLength is the size of the signing key in bytes, the size of the
+// HS256 hash.
+const secretLength = 32
+
+// LoadSecret returns the key tokens are signed with. It is generated once and
+// kept in the data directory, so tokens survive restarts. It is never derived
+// from the access codes, which viewers know.
+func LoadSecret(dataDirectory string) ([]byte, error) {
+	path := filepath.Join(dataDirectory, secretFileName)
+
+	secret, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(secret) < secretLength {
+			return nil, fmt.Errorf("secret %q is too short, delete it to generate a new one", path)
+		}
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	secret = make([]byte, secretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		// Another process created it first.
+		return LoadSecret(dataDirectory)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(secret); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	log.Infof("generated token secret %q", path)
+	return secret, nil
+}
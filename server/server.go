@@ -1,8 +1,12 @@
 package server
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -10,6 +14,8 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/williamhaley/photo-server/api"
 	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/events"
+	"github.com/williamhaley/photo-server/indexer"
 	"github.com/williamhaley/photo-server/thumbnail"
 )
 
@@ -19,13 +25,27 @@ type Server struct {
 	api                     *api.API
 	photosDirectoryRootPath string
 	thumbnailManager        *thumbnail.Manager
+	indexer                 *indexer.Indexer
+	events                  *events.Bus
+	bindAddress             string
 	httpPort                string
 	httpsPort               string
+	unixSocketPath          string
+	unixSocketMode          os.FileMode
+	basePath                string
+	trustedProxies          []*net.IPNet
+	thumbnailPlaceholder    bool
+	dev                     bool
 	httpsCertFilePath       string
 	httpsCertKeyPath        string
-	secret                  string
+	secret                  []byte
 	accessCode              string
+	adminAccessCode         string
 	staticFileSystem        http.FileSystem
+
+	// shutdown is closed when the server starts shutting down, to end
+	// requests that would otherwise never finish, like event streams.
+	shutdown <-chan struct{}
 }
 
 // New allocates a new instance of the server.
@@ -33,31 +53,57 @@ func New(
 	db *datasource.Database,
 	photosDirectoryRootPath string,
 	thumbnailManager *thumbnail.Manager,
+	indexer *indexer.Indexer,
+	eventBus *events.Bus,
+	bindAddress,
 	httpPort,
 	httpsPort,
+	unixSocketPath string,
+	unixSocketMode os.FileMode,
+	basePath string,
+	trustedProxies []*net.IPNet,
+	thumbnailPlaceholder,
+	dev bool,
 	httpsCertFilePath,
 	httpsCertKeyPath,
-	accessCode string,
+	accessCode,
+	adminAccessCode string,
+	secret []byte,
 	staticFileSystem http.FileSystem,
 ) *Server {
 	return &Server{
 		db:                      db,
-		api:                     api.New(db),
+		api:                     api.New(db, thumbnailManager, indexer, eventBus),
 		photosDirectoryRootPath: photosDirectoryRootPath,
 		thumbnailManager:        thumbnailManager,
+		indexer:                 indexer,
+		events:                  eventBus,
+		bindAddress:             bindAddress,
 		httpPort:                httpPort,
 		httpsPort:               httpsPort,
+		unixSocketPath:          unixSocketPath,
+		unixSocketMode:          unixSocketMode,
+		basePath:                strings.TrimSuffix(basePath, "/"),
+		trustedProxies:          trustedProxies,
+		thumbnailPlaceholder:    thumbnailPlaceholder,
+		dev:                     dev,
 		httpsCertFilePath:       httpsCertFilePath,
 		httpsCertKeyPath:        httpsCertKeyPath,
-		secret:                  accessCode, // TODO WFH not ideal
+		secret:                  secret,
 		accessCode:              accessCode,
+		adminAccessCode:         adminAccessCode,
 		staticFileSystem:        staticFileSystem,
 	}
 }
 
-// Start initializes the server so it starts listening for connections.
-func (s *Server) Start() error {
+// Start initializes the server so it starts listening for connections. The
+// server runs until the context is done, at which point in-flight requests are
+// drained, or until a listener fails.
+func (s *Server) Start(ctx context.Context) error {
+	s.shutdown = ctx.Done()
+
 	appRouter := chi.NewRouter()
+	appRouter.Use(ProxyHeadersMiddleware(s.trustedProxies))
 	appRouter.Use(middleware.Logger)
 	appRouter.Use(middleware.RedirectSlashes)
 	appRouter.Use(middleware.Compress(5))
@@ -65,65 +111,131 @@ func (s *Server) Start() error {
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", "X-Photo-UUID"},
 		AllowCredentials: false,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
+	if s.basePath == "" {
+		s.routes(appRouter)
+	} else {
+		appRouter.Route(s.basePath, s.routes)
+		appRouter.Get("/", func(rw http.ResponseWriter, r *http.Request) {
+			http.Redirect(rw, r, s.basePath, http.StatusFound)
+		})
+	}
+
+	activated, err := activatedListeners()
+	if err != nil {
+		return err
+	}
+
+	isUsingHTTPS := s.httpsPort != ""
+	if isUsingHTTPS {
+		return s.serveHTTPS(ctx, appRouter, activated)
+	}
+	return s.serveHTTP(ctx, appRouter, activated)
+}
+
+// routes registers every route relative to the base path.
+func (s *Server) routes(router chi.Router) {
 	tokenMiddleware := TokenMiddleware(s.secret)
 
-	appRouter.Post("/login", s.LogIn)
-	appRouter.With(tokenMiddleware).Get("/profile", s.Profile)
+	router.Post("/login", s.LogIn)
+	router.With(tokenMiddleware).Get("/profile", s.Profile)
+	router.With(tokenMiddleware).Get("/events", s.Events)
+	router.With(tokenMiddleware).Get("/memories", s.Memories)
+	router.With(tokenMiddleware).Get("/slideshow", s.Slideshow)
+
+	router.With(tokenMiddleware).Post("/graphql", s.GraphQL)
+	if s.dev {
+		router.With(tokenMiddleware).Get("/graphql", s.GraphiQL)
+	}
 
-	appRouter.Route("/api", func(rg chi.Router) {
+	router.Route("/api", func(rg chi.Router) {
 		rg.Use(tokenMiddleware)
 		rg.Get("/buckets/counts", s.BucketCounts)
 		rg.Get("/buckets/{id}", s.PhotosForBucket)
+		rg.Get("/thumbnails/stats", s.ThumbnailStats)
+		rg.Get("/shuffle", s.Shuffle)
 	})
-	appRouter.Get("/thumbnail/{uuid}.*", s.ThumbnailHandler)
-	appRouter.Get("/full/{uuid}.*", s.FullImageHandler)
-	appRouter.Handle("/*", http.FileServer(s.staticFileSystem))
+	router.Get("/thumbnail/{uuid}.*", s.ThumbnailHandler)
+	router.Get("/thumbnail/{uuid}/{size}", s.ThumbnailHandler)
+	router.Get("/display/{uuid}", s.DisplayHandler)
+	router.Get("/full/{uuid}.*", s.FullImageHandler)
+	router.Handle("/*", s.StaticHandler())
+}
 
-	isUsingHTTPS := s.httpsPort != ""
-	if isUsingHTTPS {
-		return s.serveHTTPS(appRouter)
+// httpListener uses, in order of preference, a socket passed by systemd, a
+// Unix domain socket, or a TCP port on the bind address.
+func (s *Server) httpListener(activated map[string]net.Listener) (net.Listener, error) {
+	if httpListener, ok := activated["http"]; ok {
+		return httpListener, nil
+	}
+	if s.unixSocketPath != "" {
+		return listenUnix(s.unixSocketPath, s.unixSocketMode)
 	}
-	return s.serveHTTP(appRouter)
+	return net.Listen("tcp", net.JoinHostPort(s.bindAddress, s.httpPort))
 }
 
-func (s *Server) serveHTTP(appRouter http.Handler) error {
-	httpAddress := fmt.Sprintf(":%s", s.httpPort)
-
-	log.Infof("starting http server on %q", httpAddress)
-
-	httpServer := http.Server{
-		Addr:    httpAddress,
-		Handler: appRouter,
+func (s *Server) httpsListener(activated map[string]net.Listener) (net.Listener, error) {
+	if httpsListener, ok := activated["https"]; ok {
+		return httpsListener, nil
 	}
-	return httpServer.ListenAndServe()
+	return net.Listen("tcp", net.JoinHostPort(s.bindAddress, s.httpsPort))
 }
 
-func (s *Server) serveHTTPS(appRouter http.Handler) error {
-	httpsAddress := fmt.Sprintf(":%s", s.httpsPort)
-	httpAddress := fmt.Sprintf(":%s", s.httpPort)
+func (s *Server) serveHTTP(ctx context.Context, appRouter http.Handler, activated map[string]net.Listener) error {
+	httpListener, err := s.httpListener(activated)
+	if err != nil {
+		return err
+	}
 
-	log.Infof("starting https server on %q. http traffic on %q will redirect to https", httpsAddress, httpAddress)
+	log.Infof("starting http server on %q", httpListener.Addr())
 
-	httpsServer := http.Server{
-		Addr:    httpsAddress,
-		Handler: appRouter,
-	}
+	return run(ctx, &listener{
+		name:     "http",
+		server:   &http.Server{Handler: appRouter},
+		listener: httpListener,
+	})
+}
 
-	go func() {
-		httpServer := http.Server{
-			Addr:    httpAddress,
-			Handler: http.HandlerFunc(s.HTTPtoHTTPSRedirect),
-		}
+func (s *Server) serveHTTPS(ctx context.Context, appRouter http.Handler, activated map[string]net.Listener) error {
+	certificateReloader, err := newCertificateReloader(s.httpsCertFilePath, s.httpsCertKeyPath)
+	if err != nil {
+		return err
+	}
 
-		if err := httpServer.ListenAndServe(); err != nil {
-			log.WithError(err).Error("error serving HTTP redirect traffic")
-		}
-	}()
+	httpsListener, err := s.httpsListener(activated)
+	if err != nil {
+		return err
+	}
+	httpListener, err := s.httpListener(activated)
+	if err != nil {
+		httpsListener.Close()
+		return err
+	}
 
-	return httpsServer.ListenAndServeTLS(s.httpsCertFilePath, s.httpsCertKeyPath)
+	log.Infof("starting https server on %q. http traffic on %q will redirect to https", httpsListener.Addr(), httpListener.Addr())
+
+	certificateReloader.Watch(ctx)
+
+	return run(ctx,
+		&listener{
+			name: "https",
+			server: &http.Server{
+				Handler: appRouter,
+				TLSConfig: &tls.Config{
+					GetCertificate: certificateReloader.GetCertificate,
+				},
+			},
+			listener: httpsListener,
+			tls:      true,
+		},
+		&listener{
+			name:     "http redirect",
+			server:   &http.Server{Handler: ProxyHeadersMiddleware(s.trustedProxies)(s.HTTPtoHTTPSRedirect(appRouter))},
+			listener: httpListener,
+		},
+	)
 }
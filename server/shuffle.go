@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/api"
+	"github.com/williamhaley/photo-server/model"
+)
+
+// Shuffle responds with the next photos in a random order. Pass the seed and
+// endCursor of the response as seed and after to get the page after it.
+func (s *Server) Shuffle(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	seed, filter, err := shuffleParams(query)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	first := 20
+	if value := query.Get("first"); value != "" {
+		if first, err = strconv.Atoi(value); err != nil {
+			writeError(rw, http.StatusBadRequest, "invalid first")
+			return
+		}
+	}
+
+	result, err := s.api.Shuffle(r.Context(), seed, filter, first, query.Get("after"))
+	if errors.Is(err, api.ErrInvalidArgument) {
+		writeError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("error shuffling photos")
+		writeError(rw, http.StatusInternalServerError, "error shuffling photos")
+		return
+	}
+
+	if err := json.NewEncoder(rw).Encode(result); err != nil {
+		log.WithError(err).Error("error writing response")
+	}
+}
+
+// Slideshow responds with the display size image of the photo after the
+// cursor in a random order, starting over once every photo has been shown.
+// The Link header has the URL of the next slide and the image to prefetch for
+// it. A token passed in the query string is carried over to the next URL;
+// clients using the Authorization header send it again with each request.
+func (s *Server) Slideshow(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	seed, filter, err := shuffleParams(query)
+	if err != nil {
+		s.thumbnailError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The current slide and the one after it, to prefetch.
+	page, err := s.api.Shuffle(r.Context(), seed, filter, 2, query.Get("after"))
+	if errors.Is(err, api.ErrInvalidArgument) {
+		s.thumbnailError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("error loading slideshow")
+		s.thumbnailError(rw, http.StatusInternalServerError, "error loading slideshow")
+		return
+	}
+	slides := page.UUIDs
+	if len(slides) < 2 && page.TotalCount > len(slides) {
+		start, err := s.api.Shuffle(r.Context(), seed, filter, 2-len(slides), "")
+		if err != nil {
+			log.WithError(err).Error("error starting the slideshow over")
+			s.thumbnailError(rw, http.StatusInternalServerError, "error loading slideshow")
+			return
+		}
+		slides = append(slides, start.UUIDs...)
+	}
+	if len(slides) == 0 {
+		s.thumbnailError(rw, http.StatusNotFound, "no photos")
+		return
+	}
+
+	next := url.Values{}
+	next.Set("seed", strconv.Itoa(seed))
+	next.Set("after", api.EncodeShuffleCursor(slides[0]))
+	for _, key := range []string{"folder", "from", "to", "favorites", "minRating", "token"} {
+		if value := query.Get(key); value != "" {
+			next.Set(key, value)
+		}
+	}
+	// Relative, so it resolves beneath the base path.
+	link := fmt.Sprintf(`<slideshow?%s>; rel="next"`, next.Encode())
+	if len(slides) > 1 {
+		// Display images are cached forever, so the URL changes with the
+		// orientation, as in the UI.
+		prefetch, err := s.db.GetPhoto(slides[1])
+		if err != nil {
+			log.WithError(err).Errorf("could not find photo %q to prefetch", slides[1])
+		} else {
+			link += fmt.Sprintf(`, <display/%s?o=%d>; rel="prefetch"`, prefetch.UUID, prefetch.Orientation)
+		}
+	}
+	rw.Header().Set("Link", link)
+	rw.Header().Set("X-Photo-UUID", slides[0])
+
+	s.servePhotoRendition(rw, r, slides[0], s.thumbnailManager.DisplaySize(), "no-store")
+}
+
+// shuffleParams reads the seed and filter of a shuffle from the query string.
+// A random seed is picked if there is none.
+func shuffleParams(query url.Values) (int, *model.PhotoFilter, error) {
+	seed := api.RandomSeed()
+	if value := query.Get("seed"); value != "" {
+		var err error
+		if seed, err = strconv.Atoi(value); err != nil {
+			return 0, nil, fmt.Errorf("invalid seed %q", value)
+		}
+	}
+	filter := &model.PhotoFilter{
+		Folder: query.Get("folder"),
+		From:   query.Get("from"),
+		To:     query.Get("to"),
+	}
+	if value := query.Get("favorites"); value != "" {
+		favorites, err := strconv.ParseBool(value)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid favorites %q", value)
+		}
+		filter.Favorites = favorites
+	}
+	if value := query.Get("minRating"); value != "" {
+		minRating, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid minRating %q", value)
+		}
+		filter.MinRating = minRating
+	}
+	return seed, filter, nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/williamhaley/photo-server/api"
+	"github.com/williamhaley/photo-server/datasource"
+)
+
+func TestShuffleErrors(t *testing.T) {
+	db := datasource.New(t.TempDir())
+	s := &Server{api: api.New(db, nil, nil, nil)}
+
+	shuffle := func(query string) int {
+		recorder := httptest.NewRecorder()
+		s.Shuffle(recorder, httptest.NewRequest(http.MethodGet, "/api/shuffle?"+query, nil))
+		return recorder.Code
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"seed=1", http.StatusOK},
+		{"seed=x", http.StatusBadRequest},
+		{"first=0", http.StatusBadRequest},
+		{"after=not-a-cursor", http.StatusBadRequest},
+		{"minRating=9", http.StatusBadRequest},
+		{"from=yesterday", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if code := shuffle(test.query); code != test.want {
+			t.Errorf("%q responded with %d, want %d", test.query, code, test.want)
+		}
+	}
+
+	// The database failing is not the client's fault.
+	db.Close()
+	if code := shuffle("seed=1"); code != http.StatusInternalServerError {
+		t.Errorf("responded with %d when the database is closed, want %d", code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,187 @@
+package thumbnail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/events"
+	"github.com/williamhaley/photo-server/model"
+)
+
+// touchInterval limits how often the last access of a single thumbnail is
+// written to the DB. Eviction does not need better precision than this.
+const touchInterval = time.Minute
+
+// evictionBatchSize is how many thumbnails are loaded at once while evicting.
+const evictionBatchSize = 100
+
+// Stats describe the thumbnail cache. Hits and misses only count thumbnails
+// served on demand. Requests that waited for another to render the thumbnail
+// are misses.
+type Stats struct {
+	UsageBytes  int64  `json:"usageBytes"`
+	BudgetBytes int64  `json:"budgetBytes"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+}
+
+// Stats returns the current cache usage and counters.
+func (m *Manager) Stats() (*Stats, error) {
+	usage, err := m.db.ThumbnailUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stats{
+		UsageBytes:  usage,
+		BudgetBytes: m.cacheSize,
+		Hits:        atomic.LoadUint64(&m.hits),
+		Misses:      atomic.LoadUint64(&m.misses),
+		Evictions:   atomic.LoadUint64(&m.evictions),
+	}, nil
+}
+
+// record tracks a thumbnail that was just written, and evicts others if that
+// put the cache over budget.
+func (m *Manager) record(photo *model.Photo, thumbnailPath string) {
+	info, err := os.Stat(thumbnailPath)
+	if err != nil {
+		log.WithError(err).Errorf("error checking thumbnail %q", thumbnailPath)
+		return
+	}
+
+	now := time.Now()
+	err = m.db.RecordThumbnail(&model.Thumbnail{
+		Path:       m.relativePath(thumbnailPath),
+		UUID:       photo.UUID,
+		Bytes:      info.Size(),
+		LastAccess: now.UnixNano(),
+	})
+	if err != nil {
+		return
+	}
+
+	m.touchedMutex.Lock()
+	m.touched[thumbnailPath] = now
+	m.touchedMutex.Unlock()
+
+	if m.cacheSize > 0 {
+		m.StartEvict()
+	}
+}
+
+// touch updates when a thumbnail was last served, at most once per
+// touchInterval.
+func (m *Manager) touch(thumbnailPath string) {
+	now := time.Now()
+
+	m.touchedMutex.Lock()
+	if last, ok := m.touched[thumbnailPath]; ok && now.Sub(last) < touchInterval {
+		m.touchedMutex.Unlock()
+		return
+	}
+	m.touched[thumbnailPath] = now
+	m.touchedMutex.Unlock()
+
+	m.db.TouchThumbnail(m.relativePath(thumbnailPath), now.UnixNano())
+}
+
+// Evict removes the least recently used thumbnails until usage is below 90% of
+// the budget, so that every new thumbnail does not trigger another eviction.
+// Only one eviction runs at a time. It stops early once ctx is done.
+func (m *Manager) Evict(ctx context.Context) {
+	if m.cacheSize <= 0 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&m.evicting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&m.evicting, 0)
+
+	usage, err := m.db.ThumbnailUsage()
+	if err != nil || usage <= m.cacheSize {
+		return
+	}
+	target := m.cacheSize / 10 * 9
+
+	evicted := 0
+	for usage > target && ctx.Err() == nil {
+		thumbnails, err := m.db.LeastRecentlyUsedThumbnails(evictionBatchSize)
+		if err != nil || len(thumbnails) == 0 {
+			break
+		}
+
+		progressed := false
+		for _, thumbnail := range thumbnails {
+			if usage <= target || ctx.Err() != nil {
+				break
+			}
+			thumbnailPath := filepath.Join(m.thumbnailsDirectoryPath, thumbnail.Path)
+
+			m.inflightMutex.Lock()
+			_, generating := m.inflight[thumbnailPath]
+			m.inflightMutex.Unlock()
+			if generating {
+				continue
+			}
+
+			removed, err := m.db.RemoveThumbnail(thumbnail)
+			if err != nil {
+				return
+			}
+			if !removed {
+				// Touched since it was loaded, so no longer least recently used.
+				continue
+			}
+			progressed = true
+			if err := os.Remove(thumbnailPath); err != nil && !os.IsNotExist(err) {
+				log.WithError(err).Errorf("error evicting thumbnail %q", thumbnailPath)
+			}
+
+			m.touchedMutex.Lock()
+			delete(m.touched, thumbnailPath)
+			m.touchedMutex.Unlock()
+
+			usage -= thumbnail.Bytes
+			evicted++
+			atomic.AddUint64(&m.evictions, 1)
+		}
+		if !progressed {
+			break
+		}
+	}
+
+	if evicted > 0 {
+		log.Infof("evicted %d thumbnail(s), cache is now %d of %d bytes", evicted, usage, m.cacheSize)
+		m.events.Publish(events.ThumbnailsEvicted, events.Thumbnails{Evicted: evicted, UsageBytes: usage})
+	}
+}
+
+// StartEvict evicts in the background, until done or the manager is closed.
+func (m *Manager) StartEvict() {
+	m.evictors.Add(1)
+	go func() {
+		defer m.evictors.Done()
+		m.Evict(m.closing)
+	}()
+}
+
+// Close stops the evictions started by StartEvict and waits for them, so the
+// database may be closed afterwards.
+func (m *Manager) Close() {
+	m.stop()
+	m.evictors.Wait()
+}
+
+func (m *Manager) relativePath(thumbnailPath string) string {
+	relativePath, err := filepath.Rel(m.thumbnailsDirectoryPath, thumbnailPath)
+	if err != nil {
+		return thumbnailPath
+	}
+	return relativePath
+}
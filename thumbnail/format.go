@@ -0,0 +1,86 @@
+package thumbnail
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/chai2010/webp"
+)
+
+// Format is an encoding thumbnails may be stored and served in.
+type Format string
+
+const (
+	// FormatJPEG is always generated. It is the fallback for browsers that
+	// accept nothing else.
+	FormatJPEG Format = "jpeg"
+	// FormatWebP is smaller than JPEG at the same quality.
+	FormatWebP Format = "webp"
+)
+
+// encoder writes an image in a given format.
+type encoder func(w io.Writer, img image.Image, quality int) error
+
+// encoders holds every format other than JPEG that can be generated. An AVIF
+// encoder would be registered here once a usable pure-Go or cgo encoder is
+// available to this build.
+var encoders = map[Format]encoder{
+	FormatWebP: func(w io.Writer, img image.Image, quality int) error {
+		return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+	},
+}
+
+// ParseFormat validates a format name.
+func ParseFormat(name string) (Format, error) {
+	format := Format(strings.ToLower(strings.TrimSpace(name)))
+	if format == FormatJPEG {
+		return format, nil
+	}
+	if _, ok := encoders[format]; ok {
+		return format, nil
+	}
+	return "", fmt.Errorf("unsupported thumbnail format %q", name)
+}
+
+// Extension is the file extension, without a dot, for the format.
+func (f Format) Extension() string {
+	if f == FormatJPEG {
+		return "jpg"
+	}
+	return string(f)
+}
+
+// ContentType is the MIME type for the format.
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Negotiate picks the first configured format, in order of preference, that
+// the Accept header allows. JPEG is the fallback since every browser supports
+// it, whether or not it is listed.
+func Negotiate(accept string, formats []Format) Format {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				continue
+			}
+		}
+		accepted[mediaType] = true
+	}
+
+	for _, format := range formats {
+		if format != FormatJPEG && accepted[format.ContentType()] {
+			return format
+		}
+	}
+	return FormatJPEG
+}
@@ -0,0 +1,94 @@
+package thumbnail
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+
+	"github.com/buckket/go-blurhash"
+	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/model"
+	"golang.org/x/image/draw"
+)
+
+// placeholderSize is the size the thumbnail is scaled down to before
+// describing it. A BlurHash has very little detail, and encoding it touches
+// every pixel once per component, so there is no point using more.
+const placeholderSize = 32
+
+// updatePlaceholder describes the photo from a generated (and already upright)
+// JPEG thumbnail and stores the result.
+func (m *Manager) updatePlaceholder(photo *model.Photo, thumbnailPath string) error {
+	file, err := os.Open(thumbnailPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	img, err := jpeg.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	width, height := fitWithin(bounds.Dx(), bounds.Dy(), placeholderSize)
+	small := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, bounds, draw.Src, nil)
+
+	// 4 components along the long side and 3 along the short side is what the
+	// BlurHash authors suggest.
+	xComponents, yComponents := 4, 3
+	if height > width {
+		xComponents, yComponents = 3, 4
+	}
+	hash, err := blurhash.Encode(xComponents, yComponents, small)
+	if err != nil {
+		return err
+	}
+
+	photo.BlurHash = hash
+	photo.DominantColor = dominantColor(small)
+	photo.AspectRatio = float64(bounds.Dx()) / float64(bounds.Dy())
+
+	if err := m.db.SetPhotoPlaceholder(photo); err != nil {
+		return err
+	}
+	log.Debugf("placeholder for %q is %s %s %f", photo.UUID, photo.BlurHash, photo.DominantColor, photo.AspectRatio)
+
+	return nil
+}
+
+// dominantColor buckets every pixel by its 3 most significant bits per
+// channel and returns the average color of the most common bucket. This is
+// closer to what a person would call the main color than a plain average,
+// which tends towards grey.
+func dominantColor(img *image.RGBA) string {
+	type bucket struct {
+		count, r, g, b int
+	}
+	buckets := map[int]*bucket{}
+	var best *bucket
+
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		key := (r>>5)<<6 | (g>>5)<<3 | b>>5
+		current, ok := buckets[key]
+		if !ok {
+			current = &bucket{}
+			buckets[key] = current
+		}
+		current.count++
+		current.r += r
+		current.g += g
+		current.b += b
+		if best == nil || current.count > best.count {
+			best = current
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
@@ -1,100 +1,522 @@
 package thumbnail
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/disintegration/gift"
 	log "github.com/sirupsen/logrus"
-	"github.com/williamhaley/goepeg"
-	"github.com/williamhaley/gothumb"
 	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/events"
 	"github.com/williamhaley/photo-server/model"
+	"image"
+	"image/jpeg"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// orientationFilters turn an image stored with the given EXIF orientation
+// upright. Orientation 1 is already upright.
+var orientationFilters = map[int]gift.Filter{
+	2: gift.FlipHorizontal(),
+	3: gift.Rotate180(),
+	4: gift.FlipVertical(),
+	5: gift.Transpose(),
+	6: gift.Rotate270(),
+	7: gift.Transverse(),
+	8: gift.Rotate90(),
+}
+
+// rotatedClockwise is the orientation that renders a photo with the given
+// orientation rotated a further 90 degrees clockwise.
+var rotatedClockwise = map[int]int{1: 6, 2: 7, 3: 8, 4: 5, 5: 2, 6: 3, 7: 4, 8: 1}
+
+// RotateOrientation returns the EXIF orientation that renders a photo with the
+// given orientation rotated clockwise by the degrees, a multiple of 90.
+func RotateOrientation(orientation, degrees int) (int, error) {
+	if _, ok := rotatedClockwise[orientation]; !ok {
+		return 0, fmt.Errorf("invalid orientation %d", orientation)
+	}
+	if degrees%90 != 0 {
+		return 0, fmt.Errorf("rotation must be a multiple of 90 degrees, not %d", degrees)
+	}
+	// Go's % keeps the sign, so -90 becomes 270.
+	for turns := (degrees/90%4 + 4) % 4; turns > 0; turns-- {
+		orientation = rotatedClockwise[orientation]
+	}
+	return orientation, nil
+}
+
+// ErrSourceNotFound is returned when a thumbnail must be generated but the
+// source photo no longer exists.
+var ErrSourceNotFound = errors.New("source photo not found")
+
 // Manager tracks some state needed for generating thumbnails. The DB
 // for looking up photos and the directory in which to generate photos.
 type Manager struct {
+	// Accessed atomically, so kept first for 64-bit alignment on 32-bit ARM.
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	evicting  int32
+
 	db                      *datasource.Database
 	photosDirectoryRootPath string
 	thumbnailsDirectoryPath string
+	sizes                   []int
+	displaySize             int
+	formats                 []Format
+	quality                 int
+	thumbnailer             Thumbnailer
+	events                  *events.Bus
+
+	// pool bounds how many renditions Generate may render at once.
+	pool chan struct{}
+
+	inflightMutex sync.Mutex
+	inflight      map[string]*flight
+
+	// cacheSize is the budget, in bytes, for all thumbnails. 0 is unlimited.
+	cacheSize    int64
+	touchedMutex sync.Mutex
+	touched      map[string]time.Time
+
+	// closing is done once Close is called, to stop the evictions started by
+	// StartEvict, which evictors tracks.
+	closing  context.Context
+	stop     context.CancelFunc
+	evictors sync.WaitGroup
+}
+
+// generation is how a rendition came to be on disk.
+type generation int
+
+const (
+	// existed means the rendition was already on disk.
+	existed generation = iota
+	// rendered means this call rendered the rendition.
+	rendered
+	// waited means another call was rendering the rendition, and this one
+	// waited for it.
+	waited
+)
+
+// flight is a rendition being generated. Other callers wanting the same
+// rendition wait for it to finish rather than generating it again.
+type flight struct {
+	done chan struct{}
+	err  error
 }
 
-// NewManager creates a new thumbnail manager.
-func NewManager(db *datasource.Database, photosDirectoryRootPath, thumbnailsDirectoryPath string) *Manager {
+// NewManager creates a new thumbnail manager. Each size is the maximum width
+// or height of a rendition, each of which is stored in its own directory. Each
+// rendition is generated in every format, in order of preference. JPEG is
+// always generated. The display size is the rendition used to view a single
+// photo. It is only generated on demand. The thumbnailer is the backend used to
+// scale source photos. At most onDemandWorkers renditions are rendered at once
+// by Generate. When cacheSize is more than 0, the least recently used
+// thumbnails are evicted to keep the total size, in bytes, under it.
+// Evictions are published to the event bus, which may be nil.
+func NewManager(db *datasource.Database, photosDirectoryRootPath, thumbnailsDirectoryPath string, sizes []int, displaySize int, formats []Format, quality int, thumbnailer Thumbnailer, onDemandWorkers int, cacheSize int64, eventBus *events.Bus) *Manager {
+	sorted := append([]int{}, sizes...)
+	sort.Ints(sorted)
+
+	hasJPEG := false
+	for _, format := range formats {
+		hasJPEG = hasJPEG || format == FormatJPEG
+	}
+	if !hasJPEG {
+		formats = append(formats, FormatJPEG)
+	}
+
+	closing, stop := context.WithCancel(context.Background())
+
 	return &Manager{
 		db:                      db,
 		photosDirectoryRootPath: photosDirectoryRootPath,
 		thumbnailsDirectoryPath: thumbnailsDirectoryPath,
+		sizes:                   sorted,
+		displaySize:             displaySize,
+		formats:                 formats,
+		quality:                 quality,
+		thumbnailer:             thumbnailer,
+		events:                  eventBus,
+		pool:                    make(chan struct{}, onDemandWorkers),
+		inflight:                map[string]*flight{},
+		cacheSize:               cacheSize,
+		touched:                 map[string]time.Time{},
+		closing:                 closing,
+		stop:                    stop,
+	}
+}
+
+// Sizes returns the configured renditions, smallest first.
+func (m *Manager) Sizes() []int {
+	return m.sizes
+}
+
+// DefaultSize is the rendition used when no size is requested.
+func (m *Manager) DefaultSize() int {
+	return m.sizes[0]
+}
+
+// DisplaySize is the rendition used to view a single photo.
+func (m *Manager) DisplaySize() int {
+	return m.displaySize
+}
+
+// HasSize returns whether or not the size is a configured rendition.
+func (m *Manager) HasSize(size int) bool {
+	if size == m.displaySize {
+		return true
+	}
+	for _, candidate := range m.sizes {
+		if candidate == size {
+			return true
+		}
 	}
+	return false
 }
 
-// Generate creates a thumbnail for a given photo. The thumbnail may or may not
-// be overwritten depending on the argument. The generated (or existing) file is
-// returned along with a bool indicating whether or not a thumbnail was created.
-func (m *Manager) Generate(photo *model.Photo, overwrite bool) (*os.File, bool, error) {
+// Formats returns the configured formats in order of preference.
+func (m *Manager) Formats() []Format {
+	return m.formats
+}
+
+// HasFormat returns whether or not the format is configured.
+func (m *Manager) HasFormat(format Format) bool {
+	for _, candidate := range m.formats {
+		if candidate == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Generate creates a thumbnail of the given size and format for a photo. The
+// thumbnail may or may not be overwritten depending on the argument. The
+// generated (or existing) file is returned along with a bool indicating whether
+// or not a thumbnail was created. This is meant for on-demand generation, so
+// rendering waits for a slot in the on-demand worker pool. Waiting for another
+// request rendering the same thumbnail counts as a miss, not a hit.
+func (m *Manager) Generate(photo *model.Photo, size int, format Format, overwrite bool) (*os.File, bool, error) {
+	file, generation, err := m.generate(photo, size, format, overwrite, true)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if generation == existed {
+		atomic.AddUint64(&m.hits, 1)
+		m.touch(file.Name())
+	} else {
+		atomic.AddUint64(&m.misses, 1)
+	}
+
+	return file, generation == rendered, nil
+}
+
+func (m *Manager) generate(photo *model.Photo, size int, format Format, overwrite, pooled bool) (*os.File, generation, error) {
 	uuid := photo.UUID
-	sourceImagePath := filepath.Join(m.photosDirectoryRootPath, photo.Path)
-	created := false
 
-	// Should mean we need to get to ~4096 photos before any directories need
-	// duplicates. This allows for a reasonably (fingers crossed) wide
-	// distribution of files. Not really necessary, but a nice mainteanance
-	// convenience.
-	partition := string(uuid[0:3])
-	thumbnailDirectoryPath := filepath.Join(m.thumbnailsDirectoryPath, partition)
+	if !m.HasSize(size) {
+		return nil, existed, fmt.Errorf("thumbnail size %d is not configured", size)
+	}
+	if !m.HasFormat(format) {
+		return nil, existed, fmt.Errorf("thumbnail format %q is not configured", format)
+	}
+
+	thumbnailPath := m.path(uuid, size, format)
+	thumbnailDirectoryPath := filepath.Dir(thumbnailPath)
 	if _, err := os.Stat(thumbnailDirectoryPath); os.IsNotExist(err) {
-		if err := os.Mkdir(thumbnailDirectoryPath, 0755); err != nil {
+		if err := os.MkdirAll(thumbnailDirectoryPath, 0755); err != nil {
 			// This may look weird, but is possible with multiple workers. One
 			// worker could create the dir between when we decided it didn't
 			// exist and when we tried to create it.
 			if !os.IsNotExist(err) {
 				log.WithError(err).Errorf("error creating thumbnail directory for %q", uuid)
-				return nil, false, err
+				return nil, existed, err
 			}
 		}
 	}
-	thumbnailPath := filepath.Join(thumbnailDirectoryPath, fmt.Sprintf("%s.jpg", uuid))
 
-	if _, err := os.Stat(thumbnailPath); overwrite || os.IsNotExist(err) {
-		quality := 100
-		maxSize := 200
-
-		sourceImage, err := os.Open(sourceImagePath)
+	generation := existed
+	// A zero-byte thumbnail is left behind if writing was interrupted before
+	// writes were atomic. Treat it as missing.
+	if info, err := os.Stat(thumbnailPath); overwrite || os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		generation, err = m.generateOnce(photo, size, format, thumbnailPath, pooled)
 		if err != nil {
-			log.WithError(err).Errorf("error opening source image %q", thumbnailPath)
-			return nil, false, err
+			return nil, existed, err
 		}
-		thumbnailImage, err := gothumb.Thumbnail(sourceImage, maxSize, quality, goepeg.ScaleTypeFitMax)
-		if err != nil {
-			log.WithError(err).Errorf("error generating thumbnail %q", uuid)
-			return nil, false, err
+	}
+	file, err := os.Open(thumbnailPath)
+	if err != nil {
+		log.WithError(err).Errorf("error loading thumbnail %q", uuid)
+		return nil, existed, err
+	}
+
+	return file, generation, nil
+}
+
+// path is where the thumbnail of the given size and format is stored.
+func (m *Manager) path(uuid string, size int, format Format) string {
+	// Should mean we need to get to ~4096 photos before any directories need
+	// duplicates. This allows for a reasonably (fingers crossed) wide
+	// distribution of files. Not really necessary, but a nice mainteanance
+	// convenience.
+	partition := string(uuid[0:3])
+	return filepath.Join(m.thumbnailsDirectoryPath, strconv.Itoa(size), partition, fmt.Sprintf("%s.%s", uuid, format.Extension()))
+}
+
+// generateOnce renders a thumbnail unless the same one is already being
+// rendered, in which case it waits for that to finish instead. It returns
+// whether this call rendered it or waited.
+func (m *Manager) generateOnce(photo *model.Photo, size int, format Format, thumbnailPath string, pooled bool) (generation, error) {
+	m.inflightMutex.Lock()
+	if existing, ok := m.inflight[thumbnailPath]; ok {
+		m.inflightMutex.Unlock()
+		<-existing.done
+		return waited, existing.err
+	}
+	current := &flight{done: make(chan struct{})}
+	m.inflight[thumbnailPath] = current
+	m.inflightMutex.Unlock()
+
+	defer func() {
+		m.inflightMutex.Lock()
+		delete(m.inflight, thumbnailPath)
+		m.inflightMutex.Unlock()
+		close(current.done)
+	}()
+
+	// Nothing rendered while holding a slot may wait on another flight, which
+	// could itself be waiting for the slot.
+	if pooled {
+		m.pool <- struct{}{}
+		defer func() { <-m.pool }()
+	}
+
+	var thumbnailImage io.Reader
+	if format == FormatJPEG {
+		thumbnailImage, current.err = m.renderJPEG(photo, size)
+	} else {
+		thumbnailImage, current.err = m.renderEncoded(photo, size, format)
+	}
+	if current.err != nil {
+		return rendered, current.err
+	}
+
+	current.err = writeAtomically(thumbnailPath, thumbnailImage)
+	if current.err != nil {
+		log.WithError(current.err).Errorf("error writing thumbnail file %q", photo.UUID)
+		return rendered, current.err
+	}
+	m.record(photo, thumbnailPath)
+
+	if format == FormatJPEG && size == m.DefaultSize() {
+		if err := m.updatePlaceholder(photo, thumbnailPath); err != nil {
+			log.WithError(err).Errorf("error describing placeholder for %q", photo.UUID)
 		}
-		thumbnailImageFile, err := os.OpenFile(thumbnailPath, os.O_CREATE|os.O_WRONLY, 0664)
-		if err != nil {
-			log.WithError(err).Errorf("error allocating thumbnail file %q", uuid)
-			return nil, false, err
+	}
+
+	return rendered, nil
+}
+
+// writeAtomically writes to a temporary file in the same directory and then
+// renames it into place, so a partially written thumbnail is never served.
+func writeAtomically(path string, contents io.Reader) error {
+	temporary, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	if _, err := io.Copy(temporary, contents); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temporary.Name(), 0664); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary.Name(), path)
+}
+
+// sourceQuality is the JPEG quality backends without imageThumbnailer scale
+// to when the result is encoded again in another format, so that encode is
+// the only one that loses much.
+const sourceQuality = 100
+
+// renderJPEG scales the source photo down to an upright JPEG thumbnail.
+func (m *Manager) renderJPEG(photo *model.Photo, size int) (io.Reader, error) {
+	sourceImagePath, err := m.sourcePath(photo)
+	if err != nil {
+		return nil, err
+	}
+
+	thumbnailImage, err := m.thumbnailer.Thumbnail(sourceImagePath, size, m.quality)
+	if err != nil {
+		log.WithError(err).Errorf("error generating thumbnail %q", photo.UUID)
+		return nil, err
+	}
+
+	// Backends do not auto-orient, so apply the EXIF orientation ourselves.
+	if _, ok := orientationFilters[photo.Orientation]; !ok {
+		return bytes.NewReader(thumbnailImage), nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(thumbnailImage))
+	if err != nil {
+		log.WithError(err).Errorf("error decoding thumbnail %q", photo.UUID)
+		return nil, err
+	}
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, orient(photo, img), &jpeg.Options{Quality: m.quality}); err != nil {
+		log.WithError(err).Errorf("error encoding oriented thumbnail %q", photo.UUID)
+		return nil, err
+	}
+
+	return &encoded, nil
+}
+
+// renderEncoded scales the source photo down to an upright thumbnail in a
+// format other than JPEG. It does not depend on the JPEG rendition, so it
+// never waits on another rendition while holding a pool slot.
+func (m *Manager) renderEncoded(photo *model.Photo, size int, format Format) (io.Reader, error) {
+	img, err := m.scaledImage(photo, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded bytes.Buffer
+	if err := encoders[format](&encoded, img, m.quality); err != nil {
+		log.WithError(err).Errorf("error encoding %s thumbnail %q", format, photo.UUID)
+		return nil, err
+	}
+
+	return &encoded, nil
+}
+
+// scaledImage returns the source photo scaled down and upright. Backends that
+// implement imageThumbnailer hand back the image itself. Others scale to a
+// JPEG at sourceQuality, which is decoded again.
+func (m *Manager) scaledImage(photo *model.Photo, size int) (image.Image, error) {
+	sourceImagePath, err := m.sourcePath(photo)
+	if err != nil {
+		return nil, err
+	}
+
+	var img image.Image
+	if thumbnailer, ok := m.thumbnailer.(imageThumbnailer); ok {
+		img, err = thumbnailer.ThumbnailImage(sourceImagePath, size)
+	} else {
+		var thumbnailImage []byte
+		thumbnailImage, err = m.thumbnailer.Thumbnail(sourceImagePath, size, sourceQuality)
+		if err == nil {
+			img, err = jpeg.Decode(bytes.NewReader(thumbnailImage))
 		}
-		_, err = io.Copy(thumbnailImageFile, thumbnailImage)
-		if err != nil {
-			log.WithError(err).Errorf("error writing thumbnail file %q", uuid)
-			return nil, false, err
+	}
+	if err != nil {
+		log.WithError(err).Errorf("error generating thumbnail %q", photo.UUID)
+		return nil, err
+	}
+
+	return orient(photo, img), nil
+}
+
+// sourcePath is where the source photo is, or ErrSourceNotFound if it is
+// gone.
+func (m *Manager) sourcePath(photo *model.Photo) (string, error) {
+	sourceImagePath := filepath.Join(m.photosDirectoryRootPath, photo.Path)
+
+	if _, err := os.Stat(sourceImagePath); os.IsNotExist(err) {
+		log.WithError(err).Warnf("source image %q was removed", sourceImagePath)
+		return "", ErrSourceNotFound
+	}
+
+	return sourceImagePath, nil
+}
+
+// orient applies the photo's EXIF orientation to the image.
+func orient(photo *model.Photo, img image.Image) image.Image {
+	filter, ok := orientationFilters[photo.Orientation]
+	if !ok {
+		return img
+	}
+	g := gift.New(filter)
+	oriented := image.NewRGBA(g.Bounds(img.Bounds()))
+	g.Draw(oriented, img)
+	return oriented
+}
+
+// Invalidate deletes every rendition of a photo, e.g. after it was rotated, so
+// that they are generated again when next requested.
+func (m *Manager) Invalidate(photo *model.Photo) error {
+	sizes := append([]int{m.displaySize}, m.sizes...)
+	for _, size := range sizes {
+		for _, format := range m.formats {
+			thumbnailPath := m.path(photo.UUID, size, format)
+			if err := os.Remove(thumbnailPath); err != nil && !os.IsNotExist(err) {
+				log.WithError(err).Errorf("error removing thumbnail %q", thumbnailPath)
+				return err
+			}
+			m.touchedMutex.Lock()
+			delete(m.touched, thumbnailPath)
+			m.touchedMutex.Unlock()
 		}
+	}
+	return m.db.RemoveThumbnailsForPhoto(photo.UUID)
+}
 
-		created = true
+// GenerateSizes creates every configured rendition, in every format, for a
+// photo. It returns how many renditions were created.
+func (m *Manager) GenerateSizes(photo *model.Photo, overwrite bool) (int, error) {
+	created := 0
+	// The JPEG first, since the placeholder is described from it.
+	formats := []Format{FormatJPEG}
+	for _, format := range m.formats {
+		if format != FormatJPEG {
+			formats = append(formats, format)
+		}
 	}
-	file, err := os.Open(thumbnailPath)
-	if err != nil {
-		log.WithError(err).Errorf("error loading thumbnail %q", uuid)
-		return nil, false, err
+
+	for _, size := range m.sizes {
+		for _, format := range formats {
+			file, generation, err := m.generate(photo, size, format, overwrite, false)
+			if err != nil {
+				return created, err
+			}
+			file.Close()
+			if generation == rendered {
+				created++
+			}
+		}
 	}
 
-	return file, created, nil
+	// Photos with thumbnails from before placeholders existed.
+	if photo.BlurHash == "" {
+		if err := m.updatePlaceholder(photo, m.path(photo.UUID, m.DefaultSize(), FormatJPEG)); err != nil {
+			log.WithError(err).Errorf("error describing placeholder for %q", photo.UUID)
+		}
+	}
+
+	return created, nil
 }
 
-// GenerateAll uses the db to find all photos and create a thumbnail. The
-// arguments allow skipping or overwriting existing thumbnails.
+// GenerateAll uses the db to find all photos and create every configured
+// thumbnail rendition. The arguments allow skipping or overwriting existing
+// thumbnails.
 func (m *Manager) GenerateAll(overwriteExisting bool, workers int) {
 	start := time.Now()
 	batchStart := time.Now()
@@ -104,14 +526,20 @@ func (m *Manager) GenerateAll(overwriteExisting bool, workers int) {
 	limit := 10
 	thumbnailChan := make(chan *model.Photo)
 
+	var progressMutex sync.Mutex
+	var wg sync.WaitGroup
+
 	for i := 0; i < workers; i++ {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			for photo := range thumbnailChan {
-				file, created, err := m.Generate(photo, overwriteExisting)
+				created, err := m.GenerateSizes(photo, overwriteExisting)
 				if err != nil {
 					log.WithError(err).Fatal("error generating thumbnail")
 				}
-				if created {
+				progressMutex.Lock()
+				if created > 0 {
 					count++
 					if count%batchSize == 0 {
 						batchElapsedSeconds := time.Now().Sub(batchStart).Seconds()
@@ -122,7 +550,7 @@ func (m *Manager) GenerateAll(overwriteExisting bool, workers int) {
 				} else {
 					skipped++
 				}
-				file.Close()
+				progressMutex.Unlock()
 			}
 		}()
 	}
@@ -145,6 +573,7 @@ func (m *Manager) GenerateAll(overwriteExisting bool, workers int) {
 	}
 
 	close(thumbnailChan)
+	wg.Wait()
 
 	log.Infof("[Finished] generated %d, skipped %d, processed %d, %v seconds", count, skipped, count+skipped, time.Now().Sub(start).Seconds())
 }
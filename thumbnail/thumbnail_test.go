@@ -0,0 +1,196 @@
+package thumbnail
+
+import (
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chai2010/webp"
+	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/model"
+)
+
+// slowThumbnailer holds each rendition long enough for concurrent requests to
+// overlap.
+type slowThumbnailer struct {
+	goThumbnailer
+}
+
+func (t slowThumbnailer) Thumbnail(sourcePath string, size, quality int) ([]byte, error) {
+	time.Sleep(50 * time.Millisecond)
+	return t.goThumbnailer.Thumbnail(sourcePath, size, quality)
+}
+
+func (t slowThumbnailer) ThumbnailImage(sourcePath string, size int) (image.Image, error) {
+	time.Sleep(50 * time.Millisecond)
+	return t.goThumbnailer.ThumbnailImage(sourcePath, size)
+}
+
+func newTestManager(t *testing.T, onDemandWorkers int) *Manager {
+	t.Helper()
+
+	dataDirectory := t.TempDir()
+	db := datasource.New(dataDirectory)
+	t.Cleanup(func() { db.Close() })
+
+	photosDirectory := t.TempDir()
+	file, err := os.Create(filepath.Join(photosDirectory, "source.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = jpeg.Encode(file, image.NewRGBA(image.Rect(0, 0, 400, 200)), nil)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := NewManager(db, photosDirectory, t.TempDir(), []int{100}, 300, []Format{FormatWebP, FormatJPEG}, 85, slowThumbnailer{}, onDemandWorkers, 0, nil)
+	t.Cleanup(manager.Close)
+	return manager
+}
+
+func TestGenerateBothFormatsWithOneWorker(t *testing.T) {
+	manager := newTestManager(t, 1)
+	busy := &model.Photo{UUID: "busy-photo", Path: "source.jpg"}
+	photo := &model.Photo{UUID: "both-formats", Path: "source.jpg", Orientation: 6}
+
+	generate := func(wg *sync.WaitGroup, photo *model.Photo, format Format) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, _, err := manager.Generate(photo, 100, format, false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			file.Close()
+		}()
+		// Waiters take the worker in the order they came, so the WebP is
+		// rendered while the JPEG is waiting for the worker.
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		generate(&wg, busy, FormatJPEG)
+		generate(&wg, photo, FormatWebP)
+		generate(&wg, photo, FormatJPEG)
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("generating both formats with one worker deadlocked")
+	}
+
+	// The WebP is scaled from the source and turned upright like the JPEG.
+	file, err := os.Open(manager.path(photo.UUID, 100, FormatWebP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	config, err := webp.DecodeConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 50 || config.Height != 100 {
+		t.Errorf("expected 50x100, got %dx%d", config.Width, config.Height)
+	}
+}
+
+func TestGenerateWaitingIsAMiss(t *testing.T) {
+	manager := newTestManager(t, 2)
+	photo := &model.Photo{UUID: "waited-photo", Path: "source.jpg"}
+
+	var wg sync.WaitGroup
+	created := make([]bool, 2)
+	for i := range created {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, wasCreated, err := manager.Generate(photo, 100, FormatJPEG, false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			file.Close()
+			created[i] = wasCreated
+		}(i)
+		// The second request comes while the first is rendering.
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if created[0] == created[1] {
+		t.Errorf("expected exactly one request to create the thumbnail, got %v", created)
+	}
+	stats, err := manager.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits != 0 || stats.Misses != 2 {
+		t.Errorf("expected 0 hits and 2 misses, got %d and %d", stats.Hits, stats.Misses)
+	}
+
+	// Now it is on disk.
+	file, _, err := manager.Generate(photo, 100, FormatJPEG, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if stats, _ := manager.Stats(); stats.Hits != 1 {
+		t.Errorf("expected 1 hit, got %d", stats.Hits)
+	}
+}
+
+func TestRotateOrientation(t *testing.T) {
+	tests := []struct {
+		orientation, degrees, want int
+	}{
+		{1, 0, 1},
+		{1, 90, 6},
+		{1, 180, 3},
+		{1, 270, 8},
+		{1, 360, 1},
+		{1, -90, 8},
+		{1, -270, 6},
+		{6, 90, 3},
+		{8, 90, 1},
+		{2, 90, 7},
+		{5, 90, 2},
+		{4, -90, 7},
+		{3, 450, 8},
+	}
+	for _, test := range tests {
+		got, err := RotateOrientation(test.orientation, test.degrees)
+		if err != nil {
+			t.Errorf("rotating %d by %d: %v", test.orientation, test.degrees, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("rotating %d by %d gave %d, want %d", test.orientation, test.degrees, got, test.want)
+		}
+	}
+
+	// Four turns either way are back where they started.
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, degrees := range []int{360, -360} {
+			if got, _ := RotateOrientation(orientation, degrees); got != orientation {
+				t.Errorf("rotating %d by %d gave %d", orientation, degrees, got)
+			}
+		}
+	}
+
+	for _, test := range []struct{ orientation, degrees int }{{0, 90}, {9, 90}, {1, 45}, {1, -100}} {
+		if _, err := RotateOrientation(test.orientation, test.degrees); err == nil {
+			t.Errorf("rotating %d by %d did not fail", test.orientation, test.degrees)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/williamhaley/goepeg"
+	"github.com/williamhaley/gothumb"
+	"golang.org/x/image/draw"
+)
+
+// Thumbnailer scales a source photo down to a JPEG that fits within a size by
+// size box. EXIF orientation is not applied. The Manager takes care of that.
+type Thumbnailer interface {
+	Thumbnail(sourcePath string, size, quality int) ([]byte, error)
+}
+
+// imageThumbnailer is implemented by backends that can also return the scaled
+// image before it is encoded. Formats other than JPEG are encoded from it.
+type imageThumbnailer interface {
+	ThumbnailImage(sourcePath string, size int) (image.Image, error)
+}
+
+// thumbnailers are the available backends by name.
+var thumbnailers = map[string]Thumbnailer{
+	"epeg": epegThumbnailer{},
+	"go":   goThumbnailer{},
+}
+
+// NewThumbnailer returns the named backend.
+func NewThumbnailer(name string) (Thumbnailer, error) {
+	thumbnailer, ok := thumbnailers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown thumbnail backend %q", name)
+	}
+	return thumbnailer, nil
+}
+
+// ThumbnailerNames lists the available backends.
+func ThumbnailerNames() []string {
+	names := make([]string, 0, len(thumbnailers))
+	for name := range thumbnailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// epegThumbnailer uses libepeg, which decodes JPEGs at a reduced scale and is
+// very fast. It requires cgo.
+type epegThumbnailer struct{}
+
+func (epegThumbnailer) Thumbnail(sourcePath string, size, quality int) ([]byte, error) {
+	output, err := ioutil.TempFile("", "photo-server-thumbnail-")
+	if err != nil {
+		return nil, err
+	}
+	output.Close()
+	defer os.Remove(output.Name())
+
+	// gothumb.Thumbnail would also try to auto-orient, so only scale here.
+	err = gothumb.EpegThumbnail(sourcePath, output.Name(), size, quality, goepeg.ScaleTypeFitMax)
+	if err != nil {
+		// Not every .jpg is really a JPEG epeg can handle.
+		err = gothumb.GenericThumbnail(sourcePath, output.Name(), size, quality, goepeg.ScaleTypeFitMax)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(output.Name())
+}
+
+// goThumbnailer only uses the standard library and x/image. It is slower than
+// epeg, since the full image is decoded, but has no native dependencies.
+type goThumbnailer struct{}
+
+func (t goThumbnailer) Thumbnail(sourcePath string, size, quality int) ([]byte, error) {
+	scaled, err := t.ThumbnailImage(sourcePath, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, scaled, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+
+	return encoded.Bytes(), nil
+}
+
+// fitWithin scales the dimensions down, preserving the aspect ratio, so that
+// neither exceeds size. Images are never scaled up.
+func fitWithin(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (goThumbnailer) ThumbnailImage(sourcePath string, size int) (image.Image, error) {
+	sourceImage, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceImage.Close()
+
+	decoded, _, err := image.Decode(sourceImage)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := decoded.Bounds()
+	width, height := fitWithin(bounds.Dx(), bounds.Dy(), size)
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Bounds(), decoded, bounds, draw.Src, nil)
+
+	return scaled, nil
+}
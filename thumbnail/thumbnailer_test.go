@@ -0,0 +1,113 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// benchmarkSize matches the size used by scripts/test-all.sh.
+const benchmarkSize = 800
+
+// corpus returns the JPEGs to benchmark against. Set PHOTO_SERVER_BENCH_CORPUS
+// to a directory of real photos, e.g. a sample from the NAS, for numbers that
+// mean something. Otherwise a few synthetic camera-sized JPEGs are generated.
+func corpus(b *testing.B) []string {
+	b.Helper()
+
+	if directory := os.Getenv("PHOTO_SERVER_BENCH_CORPUS"); directory != "" {
+		paths := []string{}
+		err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			extension := strings.ToLower(filepath.Ext(path))
+			if !info.IsDir() && (extension == ".jpg" || extension == ".jpeg") {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(paths) == 0 {
+			b.Fatalf("no JPEGs found in %q", directory)
+		}
+		return paths
+	}
+
+	directory := b.TempDir()
+	paths := []string{}
+	for i, bounds := range []image.Rectangle{image.Rect(0, 0, 4032, 3024), image.Rect(0, 0, 3024, 4032)} {
+		img := image.NewRGBA(bounds)
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+			}
+		}
+		path := filepath.Join(directory, fmt.Sprintf("fixture-%d.jpg", i))
+		file, err := os.Create(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = jpeg.Encode(file, img, &jpeg.Options{Quality: 90})
+		file.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// BenchmarkThumbnailers compares each backend over the same corpus.
+//
+//	go test -run x -bench Thumbnailers ./thumbnail
+func BenchmarkThumbnailers(b *testing.B) {
+	paths := corpus(b)
+
+	for _, name := range ThumbnailerNames() {
+		thumbnailer, _ := NewThumbnailer(name)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := thumbnailer.Thumbnail(paths[i%len(paths)], benchmarkSize, 85); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestThumbnailers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "source.jpg")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = jpeg.Encode(file, image.NewRGBA(image.Rect(0, 0, 1000, 500)), nil)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range ThumbnailerNames() {
+		thumbnailer, _ := NewThumbnailer(name)
+		encoded, err := thumbnailer.Thumbnail(path, 200, 85)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		config, err := jpeg.DecodeConfig(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if config.Width != 200 || config.Height != 100 {
+			t.Errorf("%s: expected 200x100, got %dx%d", name, config.Width, config.Height)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chai2010/webp"
+	log "github.com/sirupsen/logrus"
+	"github.com/williamhaley/photo-server/datasource"
+	"github.com/williamhaley/photo-server/model"
+)
+
+// decoders read back each generated format to check that it is intact.
+var decoders = map[Format]func(r io.Reader) (image.Image, error){
+	FormatJPEG: jpeg.Decode,
+	FormatWebP: webp.Decode,
+}
+
+// PartitionUsage is the disk usage of one partition directory of one size.
+type PartitionUsage struct {
+	Size      int
+	Partition string
+	Files     int
+	Bytes     int64
+}
+
+// VerifyReport summarizes a Verify run.
+type VerifyReport struct {
+	Verified    int
+	Regenerated int
+	Failed      int
+	Orphaned    int
+	Temporary   int
+	Partitions  []*PartitionUsage
+}
+
+// Verify decodes every cached thumbnail. Corrupt thumbnails (e.g. zero-byte or
+// truncated files left by an interrupted run) are regenerated. Thumbnails of
+// photos that are no longer in the DB, and temporary files left by interrupted
+// writes, are deleted. Thumbnails generated before they were tracked for cache
+// eviction start being tracked. Files that are not a configured size or format
+// are left alone.
+func (m *Manager) Verify(workers int) (*VerifyReport, error) {
+	if err := m.db.RemoveOrphanedThumbnails(); err != nil {
+		return nil, err
+	}
+
+	partitionPaths, err := filepath.Glob(filepath.Join(m.thumbnailsDirectoryPath, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{}
+	var reportMutex sync.Mutex
+	var wg sync.WaitGroup
+	partitionChan := make(chan string)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partitionPath := range partitionChan {
+				partitionReport, usage, err := m.verifyPartition(partitionPath)
+				if err != nil {
+					log.WithError(err).Errorf("error verifying thumbnails in %q", partitionPath)
+					continue
+				}
+
+				reportMutex.Lock()
+				report.Verified += partitionReport.Verified
+				report.Regenerated += partitionReport.Regenerated
+				report.Failed += partitionReport.Failed
+				report.Orphaned += partitionReport.Orphaned
+				report.Temporary += partitionReport.Temporary
+				if usage.Files > 0 {
+					report.Partitions = append(report.Partitions, usage)
+				}
+				reportMutex.Unlock()
+			}
+		}()
+	}
+
+	for _, partitionPath := range partitionPaths {
+		size, err := strconv.Atoi(filepath.Base(filepath.Dir(partitionPath)))
+		if err != nil || !m.HasSize(size) {
+			continue
+		}
+		if info, err := os.Stat(partitionPath); err != nil || !info.IsDir() {
+			continue
+		}
+		partitionChan <- partitionPath
+	}
+
+	close(partitionChan)
+	wg.Wait()
+
+	sort.Slice(report.Partitions, func(i, j int) bool {
+		if report.Partitions[i].Size != report.Partitions[j].Size {
+			return report.Partitions[i].Size < report.Partitions[j].Size
+		}
+		return report.Partitions[i].Partition < report.Partitions[j].Partition
+	})
+
+	return report, nil
+}
+
+// verifyPartition checks one partition directory. Files are handled in name
+// order so that a photo's JPEG, which other formats are encoded from, is fixed
+// before them.
+func (m *Manager) verifyPartition(partitionPath string) (*VerifyReport, *PartitionUsage, error) {
+	size, _ := strconv.Atoi(filepath.Base(filepath.Dir(partitionPath)))
+	usage := &PartitionUsage{
+		Size:      size,
+		Partition: filepath.Base(partitionPath),
+	}
+	report := &VerifyReport{}
+
+	infos, err := ioutil.ReadDir(partitionPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		thumbnailPath := filepath.Join(partitionPath, info.Name())
+
+		if strings.HasPrefix(info.Name(), ".") && strings.HasSuffix(info.Name(), ".tmp") {
+			log.Warnf("removing temporary thumbnail file %q", thumbnailPath)
+			if err := os.Remove(thumbnailPath); err != nil {
+				return nil, nil, err
+			}
+			report.Temporary++
+			continue
+		}
+
+		extension := filepath.Ext(info.Name())
+		uuid := strings.TrimSuffix(info.Name(), extension)
+		format, ok := m.formatForExtension(strings.TrimPrefix(extension, "."))
+		if !ok {
+			usage.Files++
+			usage.Bytes += info.Size()
+			continue
+		}
+
+		photo, err := m.db.GetPhoto(uuid)
+		if errors.Is(err, datasource.ErrNotFound) {
+			log.Warnf("removing orphaned thumbnail %q", thumbnailPath)
+			if err := os.Remove(thumbnailPath); err != nil {
+				return nil, nil, err
+			}
+			report.Orphaned++
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := decodeFile(thumbnailPath, format); err != nil {
+			log.WithError(err).Warnf("regenerating corrupt thumbnail %q", thumbnailPath)
+			file, _, err := m.generate(photo, size, format, true, false)
+			if err != nil {
+				log.WithError(err).Errorf("error regenerating thumbnail %q", thumbnailPath)
+				report.Failed++
+				continue
+			}
+			file.Close()
+			report.Regenerated++
+
+			if info, err = os.Stat(thumbnailPath); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			report.Verified++
+			err := m.db.ImportThumbnail(&model.Thumbnail{
+				Path:       m.relativePath(thumbnailPath),
+				UUID:       uuid,
+				Bytes:      info.Size(),
+				LastAccess: info.ModTime().UnixNano(),
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		usage.Files++
+		usage.Bytes += info.Size()
+	}
+
+	if usage.Files == 0 {
+		// Only succeeds if the directory really is empty.
+		os.Remove(partitionPath)
+	}
+
+	return report, usage, nil
+}
+
+// formatForExtension finds the configured format stored with the extension.
+func (m *Manager) formatForExtension(extension string) (Format, bool) {
+	for _, format := range m.formats {
+		if format.Extension() == extension {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+func decodeFile(path string, format Format) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = decoders[format](file)
+	return err
+}
@@ -32,7 +32,27 @@ export class YearMonthBucket {
   }
 
   appendPhotos(photos) {
-    this.photos = [...this.photos, ...photos];
+    // A photo added while the bucket was loading may be in the next page too.
+    const uuids = new Set(this.photos.map(photo => photo.uuid));
+    this.photos = [...this.photos, ...photos.filter(photo => !uuids.has(photo.uuid))];
+  }
+
+  prependPhoto(photo) {
+    this.removePhoto(photo.uuid);
+    this.photos = [photo, ...this.photos];
+    this.totalCount++;
+  }
+
+  updatePhoto(photo) {
+    this.photos = this.photos.map(existing => existing.uuid === photo.uuid ? { ...existing, ...photo } : existing);
+  }
+
+  removePhoto(uuid) {
+    const photos = this.photos.filter(photo => photo.uuid !== uuid);
+    if (photos.length !== this.photos.length) {
+      this.photos = photos;
+      this.totalCount--;
+    }
   }
 
   get grouping() {
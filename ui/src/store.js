@@ -35,6 +35,9 @@ const store = new Vuex.Store({
     apiClient: null,
     bucketsByID: {},
     isLoading: false,
+    events: null,
+    // Progress of the current indexing scan, if any.
+    scanProgress: null,
   },
   mutations: {
     setModalPhoto(state, modalPhoto) {
@@ -55,6 +58,10 @@ const store = new Vuex.Store({
 
     logOut(state) {
       console.log('store:logOut');
+      if (state.events) {
+        state.events.close();
+        state.events = null;
+      }
       state.isAuthenticated = false;
       state.token = null;
       state.apiClient = null;
@@ -91,6 +98,40 @@ const store = new Vuex.Store({
     loadedPhotosForBucket(state, { bucketID, photos }) {
       state.bucketsByID[bucketID].appendPhotos(photos);
     },
+
+    subscribedToEvents(state, events) {
+      if (state.events) {
+        state.events.close();
+      }
+      state.events = events;
+    },
+    scanProgress(state, scan) {
+      state.scanProgress = scan;
+    },
+    photoAdded(state, photo) {
+      const bucketID = `${photo.year}-${photo.month}`;
+      if (!state.bucketsByID[bucketID]) {
+        // Keep buckets sorted newest first, as the API returns them.
+        const buckets = [...Object.values(state.bucketsByID), new YearMonthBucket(bucketID, 0)];
+        buckets.sort((a, b) => (b.year - a.year) || (b.month - a.month));
+        state.bucketsByID = buckets.reduce((memo, bucket) => ({ ...memo, [bucket.id]: bucket }), {});
+      }
+      state.bucketsByID[bucketID].prependPhoto(photo);
+    },
+    photoUpdated(state, photo) {
+      for (let bucket of Object.values(state.bucketsByID)) {
+        if (photo.hidden) {
+          bucket.removePhoto(photo.uuid);
+        } else {
+          bucket.updatePhoto(photo);
+        }
+      }
+    },
+    photoRemoved(state, { uuid }) {
+      for (let bucket of Object.values(state.bucketsByID)) {
+        bucket.removePhoto(uuid);
+      }
+    },
   },
 
   actions: {
@@ -109,16 +150,18 @@ const store = new Vuex.Store({
           token: localAuthInfo.token,
           apiClient,
         });
+        context.dispatch('subscribeToEvents');
       } catch (err) {
         localStorage.setItem('authInfo', JSON.stringify({}));
         context.commit('logOut');
       }
     },
-    async logIn(context, accessCode) {
+    async logIn(context, { accessCode, user }) {
       const res = await fetch(`${process.env.VUE_APP_ROOT_URL}login`, {
         method: 'POST',
         body: JSON.stringify({
           accessCode,
+          user,
         }),
       });
 
@@ -134,6 +177,26 @@ const store = new Vuex.Store({
         token,
         apiClient: getAPIClient(token),
       });
+      context.dispatch('subscribeToEvents');
+    },
+    // Live indexing progress and photo changes. EventSource reconnects on its
+    // own and the server replays recent events that were missed.
+    subscribeToEvents(context) {
+      const params = new URLSearchParams();
+      params.append('token', context.state.token);
+      const events = new EventSource(`${process.env.VUE_APP_ROOT_URL}events?${params.toString()}`);
+
+      const on = (type, handler) => {
+        events.addEventListener(type, (event) => handler(JSON.parse(event.data)));
+      };
+      on('scan.started', scan => context.commit('scanProgress', scan));
+      on('scan.progress', scan => context.commit('scanProgress', scan));
+      on('scan.finished', () => context.commit('scanProgress', null));
+      on('photo.added', photo => context.commit('photoAdded', photo));
+      on('photo.updated', photo => context.commit('photoUpdated', photo));
+      on('photo.removed', photo => context.commit('photoRemoved', photo));
+
+      context.commit('subscribedToEvents', events);
     },
   },
 });
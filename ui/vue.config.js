@@ -0,0 +1,5 @@
+module.exports = {
+  // Relative asset paths so the UI works under any base path. The server
+  // injects a <base> element into index.html for the configured base path.
+  publicPath: '',
+};